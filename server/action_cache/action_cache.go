@@ -3,38 +3,64 @@ package action_cache
 import (
 	"bytes"
 	"encoding/gob"
+	"expvar"
+	"fmt"
+	"sync/atomic"
 
 	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
 
-	"cloud.google.com/go/storage"
 	"github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
 	"github.com/r2d4/bazel-remote-execution-go/server/cache"
+	"github.com/r2d4/bazel-remote-execution-go/server/digest"
 	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
 	watcher "google.golang.org/genproto/googleapis/watcher/v1"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 )
 
+// maxConcurrentContains bounds the number of Contains calls in flight while
+// validating a single action result.
+const maxConcurrentContains = 32
+
+// invalidatedResults counts stored results that were served as misses
+// because some of their outputs had been evicted from the CAS.
+var invalidatedResults = expvar.NewInt("action_cache_invalidated_results")
+
 type ActionCacheSrv struct {
-	Cache      cache.Cache
-	ActionChan chan watcher.Change
+	Cache          cache.Cache
+	DigestFunction *digest.Function
+	ActionChan     chan watcher.Change
+
+	// ValidateResults makes GetActionResult treat a result as a miss unless
+	// every blob it refers to is still in the CAS.
+	ValidateResults bool
 }
 
 // GetActionResult implements ActionCacheServer.GetActionResult
 func (s *ActionCacheSrv) GetActionResult(ctx context.Context, in *pb.GetActionResultRequest) (*pb.ActionResult, error) {
 	logrus.Infof("[GetActionResult] %+v", in)
-	var b bytes.Buffer
-	err := s.Cache.Get(in.ActionDigest, &b)
-	if err == storage.ErrObjectNotExist {
-		return nil, grpc.Errorf(codes.NotFound, "")
+	if err := s.DigestFunction.Validate(in.ActionDigest); err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	res, err := s.load(in.ActionDigest)
+	if err == cache.ErrNotFound {
+		return nil, grpc.Errorf(codes.NotFound, "no action result for %s/%d", in.ActionDigest.Hash, in.ActionDigest.SizeBytes)
 	}
 	if err != nil {
 		return nil, grpc.Errorf(codes.Internal, "%v", err)
 	}
-	var res *pb.ActionResult
-	dec := gob.NewDecoder(&b)
-	if err := dec.Decode(res); err != nil {
-		return nil, grpc.Errorf(codes.Internal, "%v", err)
+	if s.ValidateResults {
+		ok, err := s.outputsExist(res)
+		if err != nil {
+			return nil, grpc.Errorf(codes.Internal, "validating action result: %v", err)
+		}
+		if !ok {
+			invalidatedResults.Add(1)
+			logrus.Infof("[ACTION CACHE] outputs of %s were evicted, treating as a miss", in.ActionDigest.Hash)
+			return nil, grpc.Errorf(codes.NotFound, "outputs of action result for %s/%d are missing", in.ActionDigest.Hash, in.ActionDigest.SizeBytes)
+		}
 	}
 	return res, nil
 }
@@ -42,13 +68,176 @@ func (s *ActionCacheSrv) GetActionResult(ctx context.Context, in *pb.GetActionRe
 // UpdateActionResult implements ActionCacheServer.UpdateActionResult
 func (s *ActionCacheSrv) UpdateActionResult(ctx context.Context, in *pb.UpdateActionResultRequest) (*pb.ActionResult, error) {
 	logrus.Infof("[UpdateActionResult] %+v", in)
-	var b bytes.Buffer
-	enc := gob.NewEncoder(&b)
-	if err := enc.Encode(in.ActionResult); err != nil {
-		return nil, grpc.Errorf(codes.Internal, "%v", err)
+	if err := s.DigestFunction.Validate(in.ActionDigest); err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	if in.ActionResult == nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "missing action_result")
 	}
-	if err := s.Cache.Put(in.ActionDigest, &b); err != nil {
+	if err := s.validateResult(in.ActionResult); err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	if err := s.store(in.ActionDigest, in.ActionResult); err != nil {
 		return nil, grpc.Errorf(codes.Internal, "%v", err)
 	}
-	return nil, grpc.Errorf(codes.NotFound, "")
+	return in.ActionResult, nil
+}
+
+// load reads the result stored for an action, falling back to entries
+// written by older versions of the server.
+func (s *ActionCacheSrv) load(d *pb.Digest) (*pb.ActionResult, error) {
+	var b bytes.Buffer
+	err := s.Cache.GetAction(d, &b)
+	if err == cache.ErrNotFound {
+		return s.loadLegacy(d)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := &pb.ActionResult{}
+	if err := proto.Unmarshal(b.Bytes(), res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// loadLegacy reads a gob encoded result that an older server stored under
+// the action digest in blobs/ and migrates it to ac/. The same key holds the
+// Action itself in the CAS, so anything that does not decode is a miss.
+func (s *ActionCacheSrv) loadLegacy(d *pb.Digest) (*pb.ActionResult, error) {
+	var b bytes.Buffer
+	if err := s.Cache.Get(d, &b); err != nil {
+		return nil, err
+	}
+	res := &pb.ActionResult{}
+	if err := gob.NewDecoder(&b).Decode(res); err != nil {
+		logrus.Infof("[ACTION CACHE] %s is not a legacy action result: %s", d.Hash, err)
+		return nil, cache.ErrNotFound
+	}
+	logrus.Infof("[ACTION CACHE] migrating legacy action result %s", d.Hash)
+	if err := s.store(d, res); err != nil {
+		logrus.Warnf("[ACTION CACHE] migrating %s: %s", d.Hash, err)
+	}
+	return res, nil
+}
+
+// validateResult checks every digest res refers to, so that stored results
+// only ever lead to well formed blobs.
+func (s *ActionCacheSrv) validateResult(res *pb.ActionResult) error {
+	for _, d := range []*pb.Digest{res.StdoutDigest, res.StderrDigest} {
+		if d == nil {
+			continue
+		}
+		if err := s.DigestFunction.Validate(d); err != nil {
+			return err
+		}
+	}
+	for _, f := range res.OutputFiles {
+		if err := s.DigestFunction.Validate(f.Digest); err != nil {
+			return fmt.Errorf("output file %s: %v", f.Path, err)
+		}
+	}
+	for _, d := range res.OutputDirectories {
+		if err := s.DigestFunction.Validate(d.TreeDigest); err != nil {
+			return fmt.Errorf("output directory %s: %v", d.Path, err)
+		}
+		if d.Digest == nil {
+			continue
+		}
+		if err := s.DigestFunction.Validate(d.Digest); err != nil {
+			return fmt.Errorf("output directory %s: %v", d.Path, err)
+		}
+	}
+	return nil
+}
+
+func (s *ActionCacheSrv) store(d *pb.Digest, res *pb.ActionResult) error {
+	data, err := proto.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return s.Cache.PutAction(d, bytes.NewReader(data))
+}
+
+// outputsExist reports whether every blob res refers to is in the CAS,
+// including the files in its output directory trees.
+func (s *ActionCacheSrv) outputsExist(res *pb.ActionResult) (bool, error) {
+	digests := []*pb.Digest{res.StdoutDigest, res.StderrDigest}
+	for _, f := range res.OutputFiles {
+		digests = append(digests, f.Digest)
+	}
+	for _, d := range res.OutputDirectories {
+		digests = append(digests, d.Digest, d.TreeDigest)
+	}
+	if ok, err := s.containsAll(digests); !ok || err != nil {
+		return ok, err
+	}
+
+	var files []*pb.Digest
+	for _, d := range res.OutputDirectories {
+		if d.TreeDigest == nil {
+			continue
+		}
+		var b bytes.Buffer
+		err := s.Cache.Get(d.TreeDigest, &b)
+		if err == cache.ErrNotFound {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		var tree pb.Tree
+		if err := proto.Unmarshal(b.Bytes(), &tree); err != nil {
+			return false, err
+		}
+		for _, dir := range append([]*pb.Directory{tree.Root}, tree.Children...) {
+			for _, f := range dir.GetFiles() {
+				files = append(files, f.Digest)
+			}
+		}
+	}
+	return s.containsAll(files)
+}
+
+// containsAll checks digests concurrently, ignoring nil and empty ones.
+// Malformed digests count as missing.
+func (s *ActionCacheSrv) containsAll(digests []*pb.Digest) (bool, error) {
+	var missing int32
+	seen := map[string]bool{}
+	sem := make(chan struct{}, maxConcurrentContains)
+	var g errgroup.Group
+	for _, d := range digests {
+		if d == nil || d.SizeBytes == 0 {
+			continue
+		}
+		if err := s.DigestFunction.Validate(d); err != nil {
+			logrus.Warnf("[ACTION CACHE] %s", err)
+			return false, nil
+		}
+		key := fmt.Sprintf("%s/%d", d.Hash, d.SizeBytes)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		d := d
+		g.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if atomic.LoadInt32(&missing) > 0 {
+				return nil
+			}
+			ok, err := s.Cache.Contains(d)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				atomic.AddInt32(&missing, 1)
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return false, err
+	}
+	return missing == 0, nil
 }
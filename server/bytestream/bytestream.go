@@ -2,9 +2,12 @@ package bytestream
 
 import (
 	"io"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/r2d4/bazel-remote-execution-go/server/cache"
+	"github.com/r2d4/bazel-remote-execution-go/server/digest"
 
 	"golang.org/x/net/context"
 	"golang.org/x/sync/syncmap"
@@ -22,6 +25,7 @@ import (
 // Note: Cancelling the context will abort the stream ("drop the connection"). Consider returning a non-nil error instead.
 type ReadHandler interface {
 	// GetReader provides an io.ReaderAt, which will not be retained by the Server after the pb.ReadRequest.
+	// If the io.ReaderAt is also an io.Closer, the Server closes it once the read is done.
 	GetReader(ctx context.Context, name string) (io.ReaderAt, error)
 	// Close does not have to do anything, but is here for if the io.ReaderAt wants to call Close().
 	Close(ctx context.Context, name string) error
@@ -39,24 +43,37 @@ type WriteHandler interface {
 	// Close is called when the server receives a pb.WriteRequest with finish_write = true.
 	// If Server.AllowOverwrite == true then Close() followed by GetWriter() for the same name indicates the name is being overwritten, even if the initOffset is different.
 	Close(ctx context.Context, name string) error
+	// Abort discards everything written to name so far without committing it.
+	// Abort is called instead of Close when the written data does not match the digest in name.
+	Abort(ctx context.Context, name string) error
 }
 
 type ByteStreamSrv struct {
-	readHandler  ReadHandler
-	writeHandler WriteHandler
-	status       syncmap.Map
+	readHandler    ReadHandler
+	writeHandler   WriteHandler
+	digestFunction *digest.Function
 
-	digestMap syncmap.Map
+	// UploadTimeout is how long an unfinished upload may go without
+	// writes before it is aborted. 0 means uploads are kept until they
+	// are finished.
+	UploadTimeout time.Duration
 
-	AllowOverwrite bool
+	// Unfinished uploads, keyed by resource name including the upload
+	// UUID. Finished, aborted and expired uploads are forgotten.
+	uploads     syncmap.Map
+	initSweeper sync.Once
 }
 
-func NewByteStreamSrv(r ReadHandler, w WriteHandler) *ByteStreamSrv {
+// DefaultUploadTimeout is how long abandoned uploads are kept around for
+// their clients to resume them.
+const DefaultUploadTimeout = time.Hour
+
+func NewByteStreamSrv(r ReadHandler, w WriteHandler, fn *digest.Function) *ByteStreamSrv {
 	return &ByteStreamSrv{
 		readHandler:    r,
 		writeHandler:   w,
-		status:         syncmap.Map{},
-		AllowOverwrite: true,
+		digestFunction: fn,
+		UploadTimeout:  DefaultUploadTimeout,
 	}
 }
 
@@ -70,11 +87,25 @@ func (b *ByteStreamSrv) Read(in *bytestream.ReadRequest, stream bytestream.ByteS
 	if in.ResourceName == "" {
 		return grpc.Errorf(codes.InvalidArgument, "ReadRequest: empty or missing resource_name")
 	}
+	// Unfinished uploads are not blobs yet, and may never become any.
+	if cache.IsUploadName(in.ResourceName) {
+		return grpc.Errorf(codes.InvalidArgument, "ReadRequest: %q is an upload resource name", in.ResourceName)
+	}
+	d, err := cache.ParseResourceName(in.ResourceName)
+	if err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "ReadRequest: %v", err)
+	}
+	if err := b.digestFunction.Validate(d); err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "ReadRequest: %v", err)
+	}
 
 	reader, err := b.readHandler.GetReader(stream.Context(), in.ResourceName)
 	if err != nil {
 		return err
 	}
+	if c, ok := reader.(io.Closer); ok {
+		defer c.Close()
+	}
 	if err = b.readFrom(in, reader, stream); err != nil {
 		b.readHandler.Close(stream.Context(), in.ResourceName)
 		return err
@@ -136,82 +167,168 @@ func (b *ByteStreamSrv) Write(stream bytestream.ByteStream_WriteServer) error {
 			return grpc.Errorf(codes.Unimplemented, "instance of NewServer(writeHandler = nil) rejects all writes")
 		}
 
-		// I'm not sure how we're supposed to infer the random uuid set by the client
-		// so this removes it :shrug:
-		// uploads/%s/blobs/%s/%d
-		// -->
-		// blobs/%s/%d
-		r := strings.Split(writeReq.ResourceName, "/")
-		writeReq.ResourceName = strings.Join(r[2:], "/")
-		logrus.Infof("[BYTESTREAM] [WRITE] %s", writeReq.ResourceName)
-		var status *bytestream.QueryWriteStatusResponse
-		s, ok := b.status.Load(writeReq.ResourceName)
-		if !ok {
-			// writeReq.ResourceName is a new resource name.
-			if writeReq.ResourceName == "" {
-				return grpc.Errorf(codes.InvalidArgument, "WriteRequest: empty or missing resource_name:%s", writeReq)
-			}
-			status = &bytestream.QueryWriteStatusResponse{
-				CommittedSize: writeReq.WriteOffset,
-			}
-			b.status.Store(writeReq.ResourceName, status)
+		// Uploads are named [instance/]uploads/<uuid>/blobs/<hash>/<size>.
+		// The UUID keeps concurrent uploads of the same blob apart.
+		name := writeReq.ResourceName
+		logrus.Infof("[BYTESTREAM] [WRITE] %s", name)
+		if !cache.IsUploadName(name) {
+			return grpc.Errorf(codes.InvalidArgument, "WriteRequest: %q is not an upload resource name", name)
+		}
+		b.startSweeper()
+		var u *upload
+		if v, ok := b.uploads.Load(name); ok {
+			u = v.(*upload)
 		} else {
-			status, ok := s.(*bytestream.QueryWriteStatusResponse)
-			if !ok {
-				return grpc.Errorf(codes.Internal, "type check failed")
+			// name is a new resource name.
+			d, err := cache.ParseResourceName(name)
+			if err != nil {
+				return grpc.Errorf(codes.InvalidArgument, "WriteRequest: %v", err)
 			}
-			// writeReq.ResourceName has already been seen by this server.
-			if status.Complete {
-				if !b.AllowOverwrite {
-					return grpc.Errorf(codes.InvalidArgument, "%q finish_write = true already, got %d byte WriteRequest and Server.AllowOverwrite = false",
-						writeReq.ResourceName, len(writeReq.Data))
-				}
-				// Truncate the resource stream.
-				status.Complete = false
-				status.CommittedSize = writeReq.WriteOffset
+			if err := b.digestFunction.Validate(d); err != nil {
+				return grpc.Errorf(codes.InvalidArgument, "WriteRequest: %v", err)
 			}
+			if writeReq.WriteOffset != 0 {
+				return grpc.Errorf(codes.InvalidArgument, "%q is a new resource, got write_offset=%d", name, writeReq.WriteOffset)
+			}
+			v, _ := b.uploads.LoadOrStore(name, &upload{
+				status:   &bytestream.QueryWriteStatusResponse{},
+				verifier: cache.NewVerifier(b.digestFunction, d),
+			})
+			u = v.(*upload)
 		}
-		logrus.Infoln("writeReq:", writeReq)
-		logrus.Infoln("status:", status)
-
-		if writeReq.WriteOffset != status.CommittedSize {
-			return grpc.Errorf(codes.FailedPrecondition, "%q write_offset=%d differs from server internal committed_size=%d",
-				writeReq.ResourceName, writeReq.WriteOffset, status.CommittedSize)
+		done, err := b.write(stream, name, u, writeReq)
+		if err != nil || done {
+			return err
 		}
+	}
+}
 
-		// // WriteRequest with empty data is ok.
-		// if len(writeReq.Data) != 0 {
-		writer, err := b.writeHandler.GetWriter(stream.Context(), writeReq.ResourceName, status.CommittedSize)
-		if err != nil {
-			return grpc.Errorf(codes.Internal, "GetWriter(%q): %v", writeReq.ResourceName, err)
-		}
-		wroteLen, err := writer.Write(writeReq.Data)
-		if err != nil {
-			return grpc.Errorf(codes.Internal, "Write(%q): %v", writeReq.ResourceName, err)
+// upload is the state of an upload that has not been finished yet.
+type upload struct {
+	// mu serializes the writes of clients that reuse an upload name.
+	mu       sync.Mutex
+	status   *bytestream.QueryWriteStatusResponse
+	verifier *cache.Verifier
+	// lastWrite is when the upload last received data.
+	lastWrite time.Time
+	// done is set once the upload is finished, aborted or expired, for
+	// clients that were still waiting on mu.
+	done bool
+}
+
+// write handles one request of the upload called name, reporting whether
+// it finished the upload.
+func (b *ByteStreamSrv) write(stream bytestream.ByteStream_WriteServer, name string, u *upload, writeReq *bytestream.WriteRequest) (bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.done {
+		return false, grpc.Errorf(codes.NotFound, "%q is no longer being uploaded", name)
+	}
+	u.lastWrite = time.Now()
+	status := u.status
+	logrus.Infoln("writeReq:", writeReq)
+	logrus.Infoln("status:", status)
+
+	if writeReq.WriteOffset != status.CommittedSize {
+		return false, grpc.Errorf(codes.FailedPrecondition, "%q write_offset=%d differs from server internal committed_size=%d",
+			name, writeReq.WriteOffset, status.CommittedSize)
+	}
+
+	writer, err := b.writeHandler.GetWriter(stream.Context(), name, status.CommittedSize)
+	if err != nil {
+		return false, grpc.Errorf(codes.Internal, "GetWriter(%q): %v", name, err)
+	}
+	wroteLen, err := writer.Write(writeReq.Data)
+	if err != nil {
+		return false, grpc.Errorf(codes.Internal, "Write(%q): %v", name, err)
+	}
+	if _, err := u.verifier.Write(writeReq.Data[:wroteLen]); err != nil {
+		return false, b.abort(stream.Context(), name, u, err)
+	}
+	status.CommittedSize += int64(wroteLen)
+
+	if !writeReq.FinishWrite {
+		return false, nil
+	}
+	if err := u.verifier.Verify(); err != nil {
+		return false, b.abort(stream.Context(), name, u, err)
+	}
+	u.done = true
+	b.uploads.Delete(name)
+	if err = b.writeHandler.Close(stream.Context(), name); err != nil {
+		return false, grpc.Errorf(codes.Internal, "writeHandler.Close(%q): %v", name, err)
+	}
+	status.Complete = true
+	r := &bytestream.WriteResponse{CommittedSize: status.CommittedSize}
+	// Note: SendAndClose does NOT close the server stream.
+	if err = stream.SendAndClose(r); err != nil {
+		return false, grpc.Errorf(codes.Internal, "stream.SendAndClose(%q, WriteResponse{ %d }): %v", name, status.CommittedSize, err)
+	}
+	logrus.Infof("Finished write for %s", name)
+	return true, nil
+}
+
+// abort discards a write whose data does not match the digest in its
+// resource name, so that it is never committed to the cache.
+func (b *ByteStreamSrv) abort(ctx context.Context, name string, u *upload, cause error) error {
+	u.done = true
+	b.uploads.Delete(name)
+	if err := b.writeHandler.Abort(ctx, name); err != nil {
+		logrus.Warnf("writeHandler.Abort(%q): %v", name, err)
+	}
+	return grpc.Errorf(codes.InvalidArgument, "%q: %v", name, cause)
+}
+
+// maxSweepInterval bounds how long expired uploads are kept in memory.
+const maxSweepInterval = time.Minute
+
+// startSweeper starts aborting expired uploads in the background, on
+// first use.
+func (b *ByteStreamSrv) startSweeper() {
+	if b.UploadTimeout <= 0 {
+		return
+	}
+	b.initSweeper.Do(func() {
+		interval := b.UploadTimeout
+		if interval > maxSweepInterval {
+			interval = maxSweepInterval
 		}
-		status.CommittedSize += int64(wroteLen)
-		// }
-
-		if writeReq.FinishWrite {
-			r := &bytestream.WriteResponse{CommittedSize: status.CommittedSize}
-			// Note: SendAndClose does NOT close the server stream.
-			if err = stream.SendAndClose(r); err != nil {
-				return grpc.Errorf(codes.Internal, "stream.SendAndClose(%q, WriteResponse{ %d }): %v", writeReq.ResourceName, status.CommittedSize, err)
-			}
-			status.Complete = true
-			if err = b.writeHandler.Close(stream.Context(), writeReq.ResourceName); err != nil {
-				return grpc.Errorf(codes.Internal, "writeHandler.Close(%q): %v", writeReq.ResourceName, err)
+		go func() {
+			for now := range time.Tick(interval) {
+				b.expireUploads(now)
 			}
-			logrus.Infoln("Finished write for %s", writeReq.ResourceName)
+		}()
+	})
+}
+
+// expireUploads aborts the uploads that have not been written to for
+// UploadTimeout, so that clients that went away do not leak them.
+func (b *ByteStreamSrv) expireUploads(now time.Time) {
+	b.uploads.Range(func(k, v interface{}) bool {
+		name, u := k.(string), v.(*upload)
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		if u.done || now.Sub(u.lastWrite) < b.UploadTimeout {
+			return true
 		}
-	}
+		logrus.Infof("[BYTESTREAM] [EXPIRE] %s", name)
+		u.done = true
+		b.uploads.Delete(name)
+		if err := b.writeHandler.Abort(context.Background(), name); err != nil {
+			logrus.Warnf("writeHandler.Abort(%q): %v", name, err)
+		}
+		return true
+	})
 }
 
 func (b *ByteStreamSrv) QueryWriteStatus(ctx context.Context, in *bytestream.QueryWriteStatusRequest) (*bytestream.QueryWriteStatusResponse, error) {
-	s, ok := b.status.Load(in.ResourceName)
+	v, ok := b.uploads.Load(in.ResourceName)
 	if !ok {
 		return nil, grpc.Errorf(codes.NotFound, "resource_name not found: QueryWriteStatusRequest %v", in)
 	}
-
-	return s.(*bytestream.QueryWriteStatusResponse), nil
+	u := v.(*upload)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	status := *u.status
+	return &status, nil
 }
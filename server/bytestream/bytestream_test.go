@@ -0,0 +1,250 @@
+package bytestream
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/r2d4/bazel-remote-execution-go/server/cache/memory_cache"
+	"github.com/r2d4/bazel-remote-execution-go/server/digest"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// writeStream plays back reqs as the requests of a Write call.
+type writeStream struct {
+	grpc.ServerStream
+	reqs []*bytestream.WriteRequest
+	resp *bytestream.WriteResponse
+}
+
+func (s *writeStream) Context() context.Context { return context.Background() }
+
+func (s *writeStream) Recv() (*bytestream.WriteRequest, error) {
+	if len(s.reqs) == 0 {
+		return nil, io.EOF
+	}
+	r := s.reqs[0]
+	s.reqs = s.reqs[1:]
+	return r, nil
+}
+
+func (s *writeStream) SendAndClose(r *bytestream.WriteResponse) error {
+	s.resp = r
+	return nil
+}
+
+func TestWrite(t *testing.T) {
+	data := []byte("hello, world")
+	d := digest.SHA256.FromBytes(data)
+	upload := fmt.Sprintf("instance/uploads/0f4a3c9e/blobs/%s/%d", d.Hash, d.SizeBytes)
+	for _, c := range []struct {
+		desc     string
+		name     string
+		chunks   [][]byte
+		offsets  []int64
+		wantCode codes.Code
+	}{
+		{
+			desc:   "one chunk",
+			name:   upload,
+			chunks: [][]byte{data},
+		},
+		{
+			desc:    "several chunks",
+			name:    upload,
+			chunks:  [][]byte{data[:5], data[5:7], data[7:]},
+			offsets: []int64{0, 5, 7},
+		},
+		{
+			desc:     "wrong data",
+			name:     upload,
+			chunks:   [][]byte{[]byte("goodbye, all")},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			desc:     "too much data",
+			name:     upload,
+			chunks:   [][]byte{data, data},
+			offsets:  []int64{0, d.SizeBytes},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			desc:     "too little data",
+			name:     upload,
+			chunks:   [][]byte{data[:5]},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			desc:     "wrong offset",
+			name:     upload,
+			chunks:   [][]byte{data[:5], data[5:]},
+			offsets:  []int64{0, 4},
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			desc:     "not an upload",
+			name:     fmt.Sprintf("instance/blobs/%s/%d", d.Hash, d.SizeBytes),
+			chunks:   [][]byte{data},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			desc:     "hash is not hex",
+			name:     fmt.Sprintf("uploads/0f4a3c9e/blobs/../../%s/%d", d.Hash[6:], d.SizeBytes),
+			chunks:   [][]byte{data},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			desc:     "hash of another digest function",
+			name:     fmt.Sprintf("uploads/0f4a3c9e/blobs/%s/%d", d.Hash[:40], d.SizeBytes),
+			chunks:   [][]byte{data},
+			wantCode: codes.InvalidArgument,
+		},
+	} {
+		mem := memory_cache.NewMemoryCache(1 << 20)
+		b := NewByteStreamSrv(mem, mem, digest.SHA256)
+		stream := &writeStream{}
+		for i, chunk := range c.chunks {
+			req := &bytestream.WriteRequest{
+				ResourceName: c.name,
+				Data:         chunk,
+				FinishWrite:  i == len(c.chunks)-1,
+			}
+			if c.offsets != nil {
+				req.WriteOffset = c.offsets[i]
+			}
+			stream.reqs = append(stream.reqs, req)
+		}
+		err := b.Write(stream)
+		if got := grpc.Code(err); got != c.wantCode {
+			t.Errorf("%s: Write() = %v, want code %s", c.desc, err, c.wantCode)
+			continue
+		}
+		stored, _ := mem.Contains(d)
+		if want := c.wantCode == codes.OK; stored != want {
+			t.Errorf("%s: blob stored = %t, want %t", c.desc, stored, want)
+		}
+		if c.wantCode == codes.OK && (stream.resp == nil || stream.resp.CommittedSize != d.SizeBytes) {
+			t.Errorf("%s: response %v, want committed_size %d", c.desc, stream.resp, d.SizeBytes)
+		}
+		// Finished and aborted uploads are forgotten.
+		if c.wantCode != codes.FailedPrecondition {
+			if _, err := b.QueryWriteStatus(context.Background(), &bytestream.QueryWriteStatusRequest{ResourceName: c.name}); grpc.Code(err) != codes.NotFound {
+				t.Errorf("%s: QueryWriteStatus() = %v, want NotFound", c.desc, err)
+			}
+		}
+	}
+}
+
+func TestWriteResume(t *testing.T) {
+	data := []byte("hello, world")
+	d := digest.SHA256.FromBytes(data)
+	name := fmt.Sprintf("uploads/0f4a3c9e/blobs/%s/%d", d.Hash, d.SizeBytes)
+	mem := memory_cache.NewMemoryCache(1 << 20)
+	b := NewByteStreamSrv(mem, mem, digest.SHA256)
+
+	// A client that goes away leaves its upload to be resumed.
+	if err := b.Write(&writeStream{reqs: []*bytestream.WriteRequest{{ResourceName: name, Data: data[:5]}}}); err != nil {
+		t.Fatal(err)
+	}
+	status, err := b.QueryWriteStatus(context.Background(), &bytestream.QueryWriteStatusRequest{ResourceName: name})
+	if err != nil || status.CommittedSize != 5 || status.Complete {
+		t.Fatalf("QueryWriteStatus() = %v, %v, want committed_size 5", status, err)
+	}
+	// Another upload of the same blob does not disturb it.
+	other := fmt.Sprintf("uploads/77e1b2d0/blobs/%s/%d", d.Hash, d.SizeBytes)
+	if err := b.Write(&writeStream{reqs: []*bytestream.WriteRequest{{ResourceName: other, Data: data[:3]}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	stream := &writeStream{reqs: []*bytestream.WriteRequest{{ResourceName: name, WriteOffset: 5, Data: data[5:], FinishWrite: true}}}
+	if err := b.Write(stream); err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	if err := mem.Get(d, &got); err != nil || got.String() != string(data) {
+		t.Fatalf("stored %q, %v, want %q", got.String(), err, data)
+	}
+	if status, err := b.QueryWriteStatus(context.Background(), &bytestream.QueryWriteStatusRequest{ResourceName: other}); err != nil || status.CommittedSize != 3 {
+		t.Fatalf("QueryWriteStatus(%s) = %v, %v, want committed_size 3", other, status, err)
+	}
+}
+
+// readStream collects the data sent by a Read call.
+type readStream struct {
+	grpc.ServerStream
+	data bytes.Buffer
+}
+
+func (s *readStream) Context() context.Context { return context.Background() }
+
+func (s *readStream) Send(r *bytestream.ReadResponse) error {
+	s.data.Write(r.Data)
+	return nil
+}
+
+func TestReadUploadName(t *testing.T) {
+	data := []byte("hello, world")
+	d := digest.SHA256.FromBytes(data)
+	blob := fmt.Sprintf("blobs/%s/%d", d.Hash, d.SizeBytes)
+	upload := "uploads/0f4a3c9e/" + blob
+	mem := memory_cache.NewMemoryCache(1 << 20)
+	b := NewByteStreamSrv(mem, mem, digest.SHA256)
+	if err := mem.Put(d, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unverified data written to an upload must not reach the blob.
+	if err := b.Write(&writeStream{reqs: []*bytestream.WriteRequest{{ResourceName: upload, Data: []byte("EVIL")}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Read(&bytestream.ReadRequest{ResourceName: upload}, &readStream{}); grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Read(%s) = %v, want InvalidArgument", upload, err)
+	}
+	stream := &readStream{}
+	if err := b.Read(&bytestream.ReadRequest{ResourceName: blob}, stream); err != nil || stream.data.String() != string(data) {
+		t.Errorf("Read(%s) = %q, %v, want %q", blob, stream.data.String(), err, data)
+	}
+}
+
+func TestExpireUploads(t *testing.T) {
+	data := []byte("hello, world")
+	d := digest.SHA256.FromBytes(data)
+	name := fmt.Sprintf("uploads/0f4a3c9e/blobs/%s/%d", d.Hash, d.SizeBytes)
+	mem := memory_cache.NewMemoryCache(1 << 20)
+	b := NewByteStreamSrv(mem, mem, digest.SHA256)
+	b.UploadTimeout = time.Minute
+	if err := b.Write(&writeStream{reqs: []*bytestream.WriteRequest{{ResourceName: name, Data: data[:5]}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		after    time.Duration
+		wantCode codes.Code
+	}{
+		{after: 0},
+		{after: b.UploadTimeout / 2},
+		{after: 2 * b.UploadTimeout, wantCode: codes.NotFound},
+	} {
+		b.expireUploads(time.Now().Add(c.after))
+		_, err := b.QueryWriteStatus(context.Background(), &bytestream.QueryWriteStatusRequest{ResourceName: name})
+		if got := grpc.Code(err); got != c.wantCode {
+			t.Errorf("QueryWriteStatus() %s later = %v, want code %s", c.after, err, c.wantCode)
+		}
+	}
+
+	// The client cannot pick up where it left off once the upload expired.
+	stream := &writeStream{reqs: []*bytestream.WriteRequest{{ResourceName: name, WriteOffset: 5, Data: data[5:], FinishWrite: true}}}
+	if err := b.Write(stream); grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Write() after expiry = %v, want InvalidArgument", err)
+	}
+	if ok, _ := mem.Contains(d); ok {
+		t.Error("expired upload was stored")
+	}
+}
@@ -1,11 +1,19 @@
 package cache
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"strconv"
+	"strings"
+	"sync"
 
 	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
 )
 
+// ErrNotFound is returned by Get when the requested blob is not in the cache.
+var ErrNotFound = errors.New("cache: blob not found")
+
 type Cache interface {
 	Get(*pb.Digest, io.Writer) error
 	Put(*pb.Digest, io.Reader) error
@@ -13,9 +21,101 @@ type Cache interface {
 	Upload(Digestable, io.Reader) error
 	// ?
 	Contains(*pb.Digest) (bool, error)
+
+	// GetAction and PutAction read and write action cache entries. They are
+	// keyed by action digest like blobs, but live in a separate ac/ namespace.
+	GetAction(*pb.Digest, io.Writer) error
+	PutAction(*pb.Digest, io.Reader) error
 }
 
 type Digestable interface {
 	GetHash() string
 	GetSizeBytes() int64
 }
+
+// ParseResourceName extracts the digest from a bytestream resource name of
+// the form [instance/][uploads/<uuid>/]blobs/<hash>/<size>.
+func ParseResourceName(name string) (*pb.Digest, error) {
+	parts := strings.Split(name, "/")
+	for i := 0; i+2 < len(parts); i++ {
+		if parts[i] != "blobs" {
+			continue
+		}
+		hash := parts[i+1]
+		if !ValidHash(hash) {
+			break
+		}
+		size, err := strconv.ParseInt(parts[i+2], 10, 64)
+		if err != nil || size < 0 {
+			break
+		}
+		return &pb.Digest{Hash: hash, SizeBytes: size}, nil
+	}
+	return nil, fmt.Errorf("invalid resource name %q", name)
+}
+
+// ValidHash reports whether hash is a non-empty lowercase hex string, as
+// every digest function produces. Caches that turn hashes into paths rely on
+// it to stay inside their root.
+func ValidHash(hash string) bool {
+	if hash == "" {
+		return false
+	}
+	for _, c := range hash {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// IsUploadName reports whether name is the resource name of a bytestream
+// upload, [instance/]uploads/<uuid>/blobs/<hash>/<size>, rather than of a
+// blob to read.
+func IsUploadName(name string) bool {
+	parts := strings.Split(name, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] == "blobs" {
+			return false
+		}
+		if parts[i] == "uploads" {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteBuffer holds the data of a bytestream upload in memory until the
+// upload is finished.
+type WriteBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+	pos int
+}
+
+// SetOffset moves the write position to offset, which may not be past the data
+// written so far.
+func (w *WriteBuffer) SetOffset(offset int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if offset < 0 || offset > int64(len(w.buf)) {
+		return fmt.Errorf("invalid offset %d for upload of %d bytes", offset, len(w.buf))
+	}
+	w.pos = int(offset)
+	return nil
+}
+
+func (w *WriteBuffer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf[:w.pos], p...)
+	w.pos += len(p)
+	return len(p), nil
+}
+
+// Bytes returns the data written so far.
+func (w *WriteBuffer) Bytes() []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf
+}
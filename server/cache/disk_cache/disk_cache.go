@@ -0,0 +1,277 @@
+package disk_cache
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sync/syncmap"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/r2d4/bazel-remote-execution-go/server/cache"
+
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func NewDiskCache(dir string) (*DiskCache, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range []string{"blobs", "ac", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &DiskCache{
+		dir:     dir,
+		writers: syncmap.Map{},
+	}, nil
+}
+
+// DiskCache stores blobs in a local directory using the same
+// blobs/<hash>/<size> and ac/<hash>/<size> layout as the GCS cache. Every write goes to a
+// temporary file first and is renamed into place once complete, so
+// readers never observe a partially written blob.
+type DiskCache struct {
+	dir string
+
+	// In-progress bytestream uploads, each with a temporary file of its
+	// own, keyed by their resource name including the upload UUID.
+	writers syncmap.Map
+}
+
+func (d *DiskCache) path(in *pb.Digest) (string, error) {
+	return d.digestPath("blobs", in)
+}
+
+func (d *DiskCache) acPath(in *pb.Digest) (string, error) {
+	return d.digestPath("ac", in)
+}
+
+// digestPath returns the location of in under the namespace dir, refusing
+// digests that would point anywhere else.
+func (d *DiskCache) digestPath(dir string, in *pb.Digest) (string, error) {
+	if in == nil || !cache.ValidHash(in.Hash) || in.SizeBytes < 0 {
+		return "", fmt.Errorf("invalid digest %v", in)
+	}
+	return filepath.Join(d.dir, dir, in.Hash, fmt.Sprintf("%d", in.SizeBytes)), nil
+}
+
+// resourcePath maps a bytestream resource name onto its location in the
+// cache directory.
+func (d *DiskCache) resourcePath(name string) (string, error) {
+	digest, err := cache.ParseResourceName(name)
+	if err != nil {
+		return "", err
+	}
+	return d.path(digest)
+}
+
+func (d *DiskCache) Get(in *pb.Digest, w io.Writer) error {
+	path, err := d.path(in)
+	if err != nil {
+		return err
+	}
+	return d.get(path, w)
+}
+
+func (d *DiskCache) get(path string, w io.Writer) error {
+	logrus.Infof("[CACHE] [GET] %s", path)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		logrus.Infof("[CACHE] [MISS] %s", path)
+		return cache.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	logrus.Infof("[CACHE] [HIT] %s", path)
+	if _, err := io.Copy(w, f); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d *DiskCache) Contains(in *pb.Digest) (bool, error) {
+	path, err := d.path(in)
+	if err != nil {
+		return false, err
+	}
+	logrus.Infof("[CACHE] [CONTAINS] %s", path)
+	_, err = os.Stat(path)
+	if os.IsNotExist(err) {
+		logrus.Infof("[CACHE] [MISS] %s", path)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	logrus.Infof("[CACHE] [HIT] %s", path)
+	return true, nil
+}
+
+func (d *DiskCache) Put(in *pb.Digest, r io.Reader) error {
+	path, err := d.path(in)
+	if err != nil {
+		return err
+	}
+	return d.put(path, r)
+}
+
+func (d *DiskCache) GetAction(in *pb.Digest, w io.Writer) error {
+	path, err := d.acPath(in)
+	if err != nil {
+		return err
+	}
+	return d.get(path, w)
+}
+
+func (d *DiskCache) PutAction(in *pb.Digest, r io.Reader) error {
+	path, err := d.acPath(in)
+	if err != nil {
+		return err
+	}
+	return d.put(path, r)
+}
+
+func (d *DiskCache) Upload(in cache.Digestable, r io.Reader) error {
+	digest := &pb.Digest{
+		SizeBytes: in.GetSizeBytes(),
+		Hash:      in.GetHash(),
+	}
+	return d.Put(digest, r)
+}
+
+func (d *DiskCache) put(path string, r io.Reader) error {
+	logrus.Infof("[CACHE] [PUT] %s", path)
+	f, err := d.tempFile()
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := d.commit(f, path); err != nil {
+		return err
+	}
+	logrus.Infof("Bytes written: %d", n)
+	return nil
+}
+
+func (d *DiskCache) tempFile() (*os.File, error) {
+	return ioutil.TempFile(filepath.Join(d.dir, "tmp"), "blob-")
+}
+
+// commit closes the temporary file f and atomically renames it to path.
+func (d *DiskCache) commit(f *os.File, path string) error {
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func (d *DiskCache) GetWriter(ctx context.Context, name string, initOffset int64) (io.Writer, error) {
+	if !cache.IsUploadName(name) {
+		return nil, fmt.Errorf("%q is not an upload resource name", name)
+	}
+	if _, err := d.resourcePath(name); err != nil {
+		return nil, err
+	}
+	v, ok := d.writers.Load(name)
+	if !ok {
+		f, err := d.tempFile()
+		if err != nil {
+			return nil, err
+		}
+		v, ok = d.writers.LoadOrStore(name, f)
+		if ok {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}
+	f, ok := v.(*os.File)
+	if !ok {
+		return nil, fmt.Errorf("type assertion")
+	}
+	if _, err := f.Seek(initOffset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (d *DiskCache) GetReader(_ context.Context, name string) (io.ReaderAt, error) {
+	if cache.IsUploadName(name) {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%q is an upload, not a blob", name)
+	}
+	path, err := d.resourcePath(name)
+	if err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, grpc.Errorf(codes.NotFound, "%s not found", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Each read gets a file of its own, which the caller closes.
+	return f, nil
+}
+
+func (d *DiskCache) Abort(ctx context.Context, name string) error {
+	v, ok := d.writers.Load(name)
+	if !ok {
+		return nil
+	}
+	d.writers.Delete(name)
+	f, ok := v.(*os.File)
+	if !ok {
+		return fmt.Errorf("type assertion")
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// Close finishes a bytestream upload by moving it into place. Files
+// returned by GetReader are closed by their callers, so closing a read is
+// a no-op and never commits an upload of the same blob.
+func (d *DiskCache) Close(ctx context.Context, name string) error {
+	if !cache.IsUploadName(name) {
+		return nil
+	}
+	v, ok := d.writers.Load(name)
+	if !ok {
+		logrus.Warnf("Called Close() on %s but is already not an open writer", name)
+		return nil
+	}
+	defer d.writers.Delete(name)
+	f, ok := v.(*os.File)
+	if !ok {
+		return fmt.Errorf("type assertion")
+	}
+	path, err := d.resourcePath(name)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("[CACHE] [PUT] %s", path)
+	return d.commit(f, path)
+}
@@ -0,0 +1,100 @@
+package disk_cache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+)
+
+func newTestCache(t *testing.T) (*DiskCache, func()) {
+	dir, err := ioutil.TempDir("", "disk_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDiskCache(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return d, func() { os.RemoveAll(dir) }
+}
+
+func TestInterleavedReads(t *testing.T) {
+	d, cleanup := newTestCache(t)
+	defer cleanup()
+	ctx := context.Background()
+	data := "hello, world"
+	digest := &pb.Digest{Hash: "aa", SizeBytes: int64(len(data))}
+	if err := d.Put(digest, bytes.NewReader([]byte(data))); err != nil {
+		t.Fatal(err)
+	}
+	name := fmt.Sprintf("blobs/%s/%d", digest.Hash, digest.SizeBytes)
+
+	first, err := d.GetReader(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := d.GetReader(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first read finishes while the second is still going.
+	if err := first.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, len(data))
+	if _, err := second.ReadAt(b, 0); err != nil || string(b) != data {
+		t.Fatalf("second read = %q, %v, want %q", b, err, data)
+	}
+	if err := second.(io.Closer).Close(); err != nil {
+		t.Fatalf("closing the second read: %v", err)
+	}
+}
+
+func TestUploadsAndReads(t *testing.T) {
+	d, cleanup := newTestCache(t)
+	defer cleanup()
+	ctx := context.Background()
+	data := "hello"
+	name := fmt.Sprintf("blobs/aa/%d", len(data))
+	upload := "uploads/0f4a3c9e/" + name
+
+	w, err := d.GetWriter(ctx, upload, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(data))
+	if _, err := d.GetReader(ctx, upload); err == nil {
+		t.Errorf("GetReader(%s) succeeded", upload)
+	}
+	if err := d.Close(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetReader(ctx, name); err == nil {
+		t.Errorf("GetReader(%s) succeeded before the upload finished", name)
+	}
+
+	if err := d.Close(ctx, upload); err != nil {
+		t.Fatal(err)
+	}
+	r, err := d.GetReader(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.(io.Closer).Close()
+	b := make([]byte, len(data))
+	if _, err := r.ReadAt(b, 0); err != nil || string(b) != data {
+		t.Errorf("read %q, %v, want %q", b, err, data)
+	}
+}
@@ -43,6 +43,10 @@ func (g *GCS_Cache) path(in *pb.Digest) string {
 	return fmt.Sprintf("blobs/%s/%d", in.Hash, in.SizeBytes)
 }
 
+func (g *GCS_Cache) acPath(in *pb.Digest) string {
+	return fmt.Sprintf("ac/%s/%d", in.Hash, in.SizeBytes)
+}
+
 func (g *GCS_Cache) Get(in *pb.Digest, w io.Writer) error {
 	path := g.path(in)
 	return g.get(path, w)
@@ -52,10 +56,14 @@ func (g *GCS_Cache) get(path string, w io.Writer) error {
 	logrus.Infof("[CACHE] [GET] %s", path)
 	obj := g.bkt.Object(path)
 	r, err := obj.NewReader(g.ctx)
-	if err != nil {
+	if err == storage.ErrObjectNotExist {
 		logrus.Infof("[CACHE] [MISS] %s", path)
+		return cache.ErrNotFound
+	}
+	if err != nil {
 		return err
 	}
+	defer r.Close()
 	logrus.Infof("[CACHE] [HIT] %s", path)
 	if _, err := io.Copy(w, r); err != nil {
 		return err
@@ -85,6 +93,14 @@ func (g *GCS_Cache) Put(in *pb.Digest, r io.Reader) error {
 	return g.put(path, r)
 }
 
+func (g *GCS_Cache) GetAction(in *pb.Digest, w io.Writer) error {
+	return g.get(g.acPath(in), w)
+}
+
+func (g *GCS_Cache) PutAction(in *pb.Digest, r io.Reader) error {
+	return g.put(g.acPath(in), r)
+}
+
 func (g *GCS_Cache) Upload(in cache.Digestable, r io.Reader) error {
 	digest := &pb.Digest{
 		SizeBytes: in.GetSizeBytes(),
@@ -98,7 +114,11 @@ func (g *GCS_Cache) put(path string, r io.Reader) error {
 	logrus.Infof("[CACHE] [PUT] %s", path)
 	obj := g.bkt.Object(path)
 
-	w := obj.NewWriter(g.ctx)
+	// Cancelling the context before Close aborts the upload, so a failed
+	// read (e.g. a digest mismatch) never creates the object.
+	ctx, cancel := context.WithCancel(g.ctx)
+	defer cancel()
+	w := obj.NewWriter(ctx)
 	n, err := io.Copy(w, r)
 	if err != nil {
 		return err
@@ -138,14 +158,23 @@ func (g *GCS_Cache) Close(ctx context.Context, path string) error {
 		return fmt.Errorf("type assertion")
 	}
 
+	digest, err := cache.ParseResourceName(path)
+	if err != nil {
+		return err
+	}
 	r := rws.NewReader()
-	if err := g.put(path, r); err != nil {
+	if err := g.put(g.path(digest), r); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+func (g *GCS_Cache) Abort(ctx context.Context, path string) error {
+	g.rws.Delete(path)
+	return nil
+}
+
 // https://stackoverflow.com/a/45837752
 type readWriteSeeker struct {
 	buf []byte
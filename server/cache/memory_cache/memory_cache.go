@@ -0,0 +1,218 @@
+package memory_cache
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sync/syncmap"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/r2d4/bazel-remote-execution-go/server/cache"
+
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func NewMemoryCache(maxBytes int64) *MemoryCache {
+	return &MemoryCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+		uploads:  syncmap.Map{},
+	}
+}
+
+// MemoryCache keeps blobs in RAM, evicting the least recently used ones
+// once the total size of the stored blobs would exceed maxBytes.
+type MemoryCache struct {
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+
+	// In-progress bytestream uploads, keyed by resource name.
+	uploads syncmap.Map
+}
+
+type entry struct {
+	key  string
+	data []byte
+}
+
+func (m *MemoryCache) key(in *pb.Digest) string {
+	return fmt.Sprintf("blobs/%s/%d", in.Hash, in.SizeBytes)
+}
+
+func (m *MemoryCache) acKey(in *pb.Digest) string {
+	return fmt.Sprintf("ac/%s/%d", in.Hash, in.SizeBytes)
+}
+
+func (m *MemoryCache) Get(in *pb.Digest, w io.Writer) error {
+	return m.get(m.key(in), w)
+}
+
+func (m *MemoryCache) get(key string, w io.Writer) error {
+	logrus.Infof("[CACHE] [GET] %s", key)
+	data, ok := m.load(key)
+	if !ok {
+		logrus.Infof("[CACHE] [MISS] %s", key)
+		return cache.ErrNotFound
+	}
+	logrus.Infof("[CACHE] [HIT] %s", key)
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *MemoryCache) Contains(in *pb.Digest) (bool, error) {
+	key := m.key(in)
+	logrus.Infof("[CACHE] [CONTAINS] %s", key)
+	m.mu.Lock()
+	_, ok := m.entries[key]
+	m.mu.Unlock()
+	if !ok {
+		logrus.Infof("[CACHE] [MISS] %s", key)
+		return false, nil
+	}
+	logrus.Infof("[CACHE] [HIT] %s", key)
+	return true, nil
+}
+
+func (m *MemoryCache) Put(in *pb.Digest, r io.Reader) error {
+	return m.put(m.key(in), r)
+}
+
+func (m *MemoryCache) GetAction(in *pb.Digest, w io.Writer) error {
+	return m.get(m.acKey(in), w)
+}
+
+func (m *MemoryCache) PutAction(in *pb.Digest, r io.Reader) error {
+	return m.put(m.acKey(in), r)
+}
+
+func (m *MemoryCache) Upload(in cache.Digestable, r io.Reader) error {
+	digest := &pb.Digest{
+		SizeBytes: in.GetSizeBytes(),
+		Hash:      in.GetHash(),
+	}
+	return m.put(m.key(digest), r)
+}
+
+func (m *MemoryCache) put(key string, r io.Reader) error {
+	logrus.Infof("[CACHE] [PUT] %s", key)
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return m.store(key, data)
+}
+
+// load returns the blob stored under key and marks it as recently used.
+func (m *MemoryCache) load(key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	m.lru.MoveToFront(e)
+	return e.Value.(*entry).data, true
+}
+
+// store adds data under key, evicting least recently used blobs until it fits.
+func (m *MemoryCache) store(key string, data []byte) error {
+	n := int64(len(data))
+	if n > m.maxBytes {
+		return fmt.Errorf("%s is %d bytes, larger than the memory cache size of %d bytes", key, n, m.maxBytes)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.entries[key]; ok {
+		m.size -= int64(len(e.Value.(*entry).data))
+		m.lru.Remove(e)
+		delete(m.entries, key)
+	}
+	for m.size+n > m.maxBytes {
+		e := m.lru.Back()
+		old := e.Value.(*entry)
+		logrus.Infof("[CACHE] [EVICT] %s", old.key)
+		m.size -= int64(len(old.data))
+		m.lru.Remove(e)
+		delete(m.entries, old.key)
+	}
+	m.entries[key] = m.lru.PushFront(&entry{key: key, data: data})
+	m.size += n
+	return nil
+}
+
+func (m *MemoryCache) GetWriter(ctx context.Context, name string, initOffset int64) (io.Writer, error) {
+	if !cache.IsUploadName(name) {
+		return nil, fmt.Errorf("%q is not an upload resource name", name)
+	}
+	if _, err := cache.ParseResourceName(name); err != nil {
+		return nil, err
+	}
+	v, _ := m.uploads.LoadOrStore(name, &cache.WriteBuffer{})
+	u, ok := v.(*cache.WriteBuffer)
+	if !ok {
+		return nil, fmt.Errorf("type assertion")
+	}
+	if err := u.SetOffset(initOffset); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (m *MemoryCache) GetReader(_ context.Context, name string) (io.ReaderAt, error) {
+	if cache.IsUploadName(name) {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%q is an upload, not a blob", name)
+	}
+	digest, err := cache.ParseResourceName(name)
+	if err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	data, ok := m.load(m.key(digest))
+	if !ok {
+		return nil, grpc.Errorf(codes.NotFound, "%s not found", name)
+	}
+	return bytes.NewReader(data), nil
+}
+
+func (m *MemoryCache) Abort(ctx context.Context, name string) error {
+	m.uploads.Delete(name)
+	return nil
+}
+
+// Close stores a finished, verified bytestream upload. Readers need no
+// cleanup, and closing one never commits an upload of the same blob.
+func (m *MemoryCache) Close(ctx context.Context, name string) error {
+	if !cache.IsUploadName(name) {
+		return nil
+	}
+	v, ok := m.uploads.Load(name)
+	if !ok {
+		return nil
+	}
+	defer m.uploads.Delete(name)
+	u, ok := v.(*cache.WriteBuffer)
+	if !ok {
+		return fmt.Errorf("type assertion")
+	}
+	digest, err := cache.ParseResourceName(name)
+	if err != nil {
+		return err
+	}
+	key := m.key(digest)
+	logrus.Infof("[CACHE] [PUT] %s", key)
+	return m.store(key, u.Bytes())
+}
@@ -0,0 +1,173 @@
+package memory_cache
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/r2d4/bazel-remote-execution-go/server/cache"
+
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func blob(hash, data string) (*pb.Digest, string) {
+	return &pb.Digest{Hash: hash, SizeBytes: int64(len(data))}, data
+}
+
+func TestPutGetContains(t *testing.T) {
+	m := NewMemoryCache(1 << 10)
+	stored, data := blob("aa", "hello")
+	if err := m.Put(stored, strings.NewReader(data)); err != nil {
+		t.Fatalf("Put() = %v", err)
+	}
+
+	for _, c := range []struct {
+		desc string
+		d    *pb.Digest
+		want string
+		ok   bool
+	}{
+		{desc: "stored blob", d: stored, want: data, ok: true},
+		{desc: "other hash", d: &pb.Digest{Hash: "bb", SizeBytes: 5}},
+		{desc: "other size", d: &pb.Digest{Hash: "aa", SizeBytes: 4}},
+	} {
+		ok, err := m.Contains(c.d)
+		if err != nil || ok != c.ok {
+			t.Errorf("%s: Contains() = %t, %v, want %t", c.desc, ok, err, c.ok)
+		}
+		var b bytes.Buffer
+		err = m.Get(c.d, &b)
+		if !c.ok {
+			if err != cache.ErrNotFound {
+				t.Errorf("%s: Get() = %v, want ErrNotFound", c.desc, err)
+			}
+			continue
+		}
+		if err != nil || b.String() != c.want {
+			t.Errorf("%s: Get() = %q, %v, want %q", c.desc, b.String(), err, c.want)
+		}
+	}
+}
+
+func TestEviction(t *testing.T) {
+	for _, c := range []struct {
+		desc string
+		// ops are "put <hash> <data>" or "get <hash> <size>".
+		ops     []string
+		present []string
+		absent  []string
+	}{
+		{
+			desc:    "fits",
+			ops:     []string{"put aa 1234", "put bb 1234"},
+			present: []string{"aa", "bb"},
+		},
+		{
+			desc:    "oldest goes first",
+			ops:     []string{"put aa 1234", "put bb 1234", "put cc 1234"},
+			present: []string{"bb", "cc"},
+			absent:  []string{"aa"},
+		},
+		{
+			desc:    "reads count as use",
+			ops:     []string{"put aa 1234", "put bb 1234", "get aa 4", "put cc 1234"},
+			present: []string{"aa", "cc"},
+			absent:  []string{"bb"},
+		},
+		{
+			desc:    "large blobs evict several",
+			ops:     []string{"put aa 12", "put bb 12", "put cc 12", "put dd 1234567"},
+			present: []string{"dd"},
+			absent:  []string{"aa", "bb", "cc"},
+		},
+		{
+			desc:    "storing again does not count twice",
+			ops:     []string{"put aa 1234", "put aa 1234", "put bb 1234"},
+			present: []string{"aa", "bb"},
+		},
+	} {
+		m := NewMemoryCache(8)
+		sizes := map[string]int64{}
+		for _, op := range c.ops {
+			f := strings.Fields(op)
+			switch f[0] {
+			case "put":
+				d, data := blob(f[1], f[2])
+				sizes[f[1]] = d.SizeBytes
+				if err := m.Put(d, strings.NewReader(data)); err != nil {
+					t.Fatalf("%s: %s: %v", c.desc, op, err)
+				}
+			case "get":
+				var b bytes.Buffer
+				if err := m.Get(&pb.Digest{Hash: f[1], SizeBytes: sizes[f[1]]}, &b); err != nil {
+					t.Fatalf("%s: %s: %v", c.desc, op, err)
+				}
+			}
+		}
+		for _, hash := range c.present {
+			if ok, _ := m.Contains(&pb.Digest{Hash: hash, SizeBytes: sizes[hash]}); !ok {
+				t.Errorf("%s: %s was evicted", c.desc, hash)
+			}
+		}
+		for _, hash := range c.absent {
+			if ok, _ := m.Contains(&pb.Digest{Hash: hash, SizeBytes: sizes[hash]}); ok {
+				t.Errorf("%s: %s was kept", c.desc, hash)
+			}
+		}
+		if m.size > m.maxBytes {
+			t.Errorf("%s: %d bytes stored, more than the budget of %d", c.desc, m.size, m.maxBytes)
+		}
+	}
+}
+
+func TestBlobLargerThanCache(t *testing.T) {
+	m := NewMemoryCache(4)
+	if err := m.Put(&pb.Digest{Hash: "aa", SizeBytes: 5}, strings.NewReader("12345")); err == nil {
+		t.Fatal("Put() of a blob larger than the cache succeeded")
+	}
+}
+
+func TestUploadsAndReads(t *testing.T) {
+	ctx := context.Background()
+	d, data := blob("aa", "hello")
+	name := fmt.Sprintf("instance/blobs/%s/%d", d.Hash, d.SizeBytes)
+	upload := fmt.Sprintf("instance/uploads/0f4a3c9e/blobs/%s/%d", d.Hash, d.SizeBytes)
+	m := NewMemoryCache(1 << 10)
+
+	if _, err := m.GetWriter(ctx, name, 0); err == nil {
+		t.Errorf("GetWriter(%s) succeeded", name)
+	}
+	w, err := m.GetWriter(ctx, upload, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(data))
+	if _, err := m.GetReader(ctx, upload); grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("GetReader(%s) = %v, want InvalidArgument", upload, err)
+	}
+
+	// Closing the blob name is the end of a read and commits nothing.
+	if err := m.Close(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.GetReader(ctx, name); grpc.Code(err) != codes.NotFound {
+		t.Errorf("GetReader(%s) before the upload finished = %v, want NotFound", name, err)
+	}
+
+	if err := m.Close(ctx, upload); err != nil {
+		t.Fatal(err)
+	}
+	r, err := m.GetReader(ctx, name)
+	if err != nil {
+		t.Fatalf("GetReader(%s) = %v", name, err)
+	}
+	b := make([]byte, d.SizeBytes)
+	if _, err := r.ReadAt(b, 0); err != nil || string(b) != data {
+		t.Errorf("read %q, %v, want %q", b, err, data)
+	}
+}
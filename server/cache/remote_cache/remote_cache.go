@@ -0,0 +1,177 @@
+package remote_cache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"golang.org/x/net/context"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
+	"github.com/r2d4/bazel-remote-execution-go/server/cache"
+	"github.com/r2d4/bazel-remote-execution-go/server/uuid"
+
+	"google.golang.org/genproto/googleapis/bytestream"
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// chunkSize is how much data is sent in one bytestream message.
+const chunkSize = 64 << 10
+
+// NewRemoteCache returns a cache that stores blobs in the CAS and action
+// cache of the server at the other end of conn.
+func NewRemoteCache(conn *grpc.ClientConn, instanceName string) *RemoteCache {
+	return &RemoteCache{
+		instanceName: instanceName,
+		bs:           bytestream.NewByteStreamClient(conn),
+		cas:          pb.NewContentAddressableStorageClient(conn),
+		ac:           pb.NewActionCacheClient(conn),
+		ctx:          context.Background(),
+	}
+}
+
+// RemoteCache is a cache backed by another server, which lets workers use
+// the CAS of the server they run actions for.
+type RemoteCache struct {
+	instanceName string
+	bs           bytestream.ByteStreamClient
+	cas          pb.ContentAddressableStorageClient
+	ac           pb.ActionCacheClient
+	ctx          context.Context
+}
+
+func (r *RemoteCache) resourceName(in *pb.Digest) string {
+	name := fmt.Sprintf("blobs/%s/%d", in.Hash, in.SizeBytes)
+	if r.instanceName != "" {
+		name = r.instanceName + "/" + name
+	}
+	return name
+}
+
+func (r *RemoteCache) Get(in *pb.Digest, w io.Writer) error {
+	name := r.resourceName(in)
+	logrus.Infof("[CACHE] [GET] %s", name)
+	stream, err := r.bs.Read(r.ctx, &bytestream.ReadRequest{ResourceName: name})
+	if err != nil {
+		return err
+	}
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if grpc.Code(err) == codes.NotFound {
+			logrus.Infof("[CACHE] [MISS] %s", name)
+			return cache.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(resp.Data); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *RemoteCache) Put(in *pb.Digest, rd io.Reader) error {
+	name := fmt.Sprintf("uploads/%s/blobs/%s/%d", uuid.New(), in.Hash, in.SizeBytes)
+	if r.instanceName != "" {
+		name = r.instanceName + "/" + name
+	}
+	logrus.Infof("[CACHE] [PUT] %s", name)
+	stream, err := r.bs.Write(r.ctx)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, chunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(rd, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			stream.CloseSend()
+			return err
+		}
+		// The server wants the resource name on every request, not just
+		// the first.
+		err = stream.Send(&bytestream.WriteRequest{
+			ResourceName: name,
+			WriteOffset:  offset,
+			FinishWrite:  last,
+			Data:         buf[:n],
+		})
+		if err != nil {
+			// The server ended the stream; CloseAndRecv returns why.
+			break
+		}
+		offset += int64(n)
+		if last {
+			break
+		}
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	if resp.CommittedSize != in.SizeBytes {
+		return fmt.Errorf("%s: committed %d of %d bytes", name, resp.CommittedSize, in.SizeBytes)
+	}
+	return nil
+}
+
+func (r *RemoteCache) Upload(in cache.Digestable, rd io.Reader) error {
+	return r.Put(&pb.Digest{Hash: in.GetHash(), SizeBytes: in.GetSizeBytes()}, rd)
+}
+
+func (r *RemoteCache) Contains(in *pb.Digest) (bool, error) {
+	logrus.Infof("[CACHE] [CONTAINS] %s", r.resourceName(in))
+	resp, err := r.cas.FindMissingBlobs(r.ctx, &pb.FindMissingBlobsRequest{
+		InstanceName: r.instanceName,
+		BlobDigests:  []*pb.Digest{in},
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(resp.MissingBlobDigests) == 0, nil
+}
+
+func (r *RemoteCache) GetAction(in *pb.Digest, w io.Writer) error {
+	logrus.Infof("[CACHE] [GET] ac/%s/%d", in.Hash, in.SizeBytes)
+	res, err := r.ac.GetActionResult(r.ctx, &pb.GetActionResultRequest{
+		InstanceName: r.instanceName,
+		ActionDigest: in,
+	})
+	if grpc.Code(err) == codes.NotFound {
+		return cache.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	b, err := proto.Marshal(res)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func (r *RemoteCache) PutAction(in *pb.Digest, rd io.Reader) error {
+	logrus.Infof("[CACHE] [PUT] ac/%s/%d", in.Hash, in.SizeBytes)
+	var b bytes.Buffer
+	if _, err := b.ReadFrom(rd); err != nil {
+		return err
+	}
+	var res pb.ActionResult
+	if err := proto.Unmarshal(b.Bytes(), &res); err != nil {
+		return err
+	}
+	_, err := r.ac.UpdateActionResult(r.ctx, &pb.UpdateActionResultRequest{
+		InstanceName: r.instanceName,
+		ActionDigest: in,
+		ActionResult: &res,
+	})
+	return err
+}
@@ -0,0 +1,222 @@
+package tiered_cache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sync/syncmap"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/r2d4/bazel-remote-execution-go/server/cache"
+
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// NewTieredCache layers tiers from fastest to slowest, e.g.
+// memory -> disk -> GCS. The last tier is treated as the source of truth.
+func NewTieredCache(tiers ...cache.Cache) *TieredCache {
+	return &TieredCache{
+		tiers:   tiers,
+		uploads: syncmap.Map{},
+	}
+}
+
+// TieredCache reads through its tiers in order, copying blobs found in a
+// slower tier into the faster ones, and writes through to every tier.
+type TieredCache struct {
+	tiers []cache.Cache
+
+	// In-progress bytestream uploads, keyed by resource name. They are
+	// spooled to temporary files rather than held in memory, since the
+	// slowest tier may take blobs of any size.
+	uploads syncmap.Map
+}
+
+func (t *TieredCache) Get(in *pb.Digest, w io.Writer) error {
+	return t.get(in, w, cache.Cache.Get, cache.Cache.Put)
+}
+
+func (t *TieredCache) GetAction(in *pb.Digest, w io.Writer) error {
+	return t.get(in, w, cache.Cache.GetAction, cache.Cache.PutAction)
+}
+
+type getFunc func(cache.Cache, *pb.Digest, io.Writer) error
+type putFunc func(cache.Cache, *pb.Digest, io.Reader) error
+
+func (t *TieredCache) get(in *pb.Digest, w io.Writer, get getFunc, put putFunc) error {
+	lastErr := cache.ErrNotFound
+	for i, tier := range t.tiers {
+		var b bytes.Buffer
+		err := get(tier, in, &b)
+		if err == cache.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			logrus.Warnf("[CACHE] [TIER %d] get %s: %s", i, in.Hash, err)
+			lastErr = err
+			continue
+		}
+		for j := 0; j < i; j++ {
+			if err := put(t.tiers[j], in, bytes.NewReader(b.Bytes())); err != nil {
+				logrus.Warnf("[CACHE] [TIER %d] populating %s: %s", j, in.Hash, err)
+			}
+		}
+		_, err = w.Write(b.Bytes())
+		return err
+	}
+	return lastErr
+}
+
+// Contains reports whether any tier has the blob, asking the cheapest first.
+func (t *TieredCache) Contains(in *pb.Digest) (bool, error) {
+	var lastErr error
+	for i, tier := range t.tiers {
+		ok, err := tier.Contains(in)
+		if err != nil {
+			logrus.Warnf("[CACHE] [TIER %d] contains %s: %s", i, in.Hash, err)
+			lastErr = err
+			continue
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, lastErr
+}
+
+func (t *TieredCache) Put(in *pb.Digest, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return t.put(in, bytes.NewReader(data), cache.Cache.Put)
+}
+
+func (t *TieredCache) PutAction(in *pb.Digest, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return t.put(in, bytes.NewReader(data), cache.Cache.PutAction)
+}
+
+func (t *TieredCache) Upload(in cache.Digestable, r io.Reader) error {
+	digest := &pb.Digest{
+		SizeBytes: in.GetSizeBytes(),
+		Hash:      in.GetHash(),
+	}
+	return t.Put(digest, r)
+}
+
+// put writes to the slowest tier first so that a faster tier never holds a
+// blob the source of truth is missing. Only failures of the last tier are
+// returned; the others are caches and merely logged.
+func (t *TieredCache) put(in *pb.Digest, r io.ReadSeeker, put putFunc) error {
+	for i := len(t.tiers) - 1; i >= 0; i-- {
+		_, err := r.Seek(0, io.SeekStart)
+		if err == nil {
+			err = put(t.tiers[i], in, r)
+		}
+		if err == nil {
+			continue
+		}
+		if i == len(t.tiers)-1 {
+			return err
+		}
+		logrus.Warnf("[CACHE] [TIER %d] put %s: %s", i, in.Hash, err)
+	}
+	return nil
+}
+
+func (t *TieredCache) GetWriter(ctx context.Context, name string, initOffset int64) (io.Writer, error) {
+	if !cache.IsUploadName(name) {
+		return nil, fmt.Errorf("%q is not an upload resource name", name)
+	}
+	if _, err := cache.ParseResourceName(name); err != nil {
+		return nil, err
+	}
+	v, ok := t.uploads.Load(name)
+	if !ok {
+		f, err := ioutil.TempFile("", "upload-")
+		if err != nil {
+			return nil, err
+		}
+		v, ok = t.uploads.LoadOrStore(name, f)
+		if ok {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}
+	f, ok := v.(*os.File)
+	if !ok {
+		return nil, fmt.Errorf("type assertion")
+	}
+	if _, err := f.Seek(initOffset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (t *TieredCache) GetReader(_ context.Context, name string) (io.ReaderAt, error) {
+	if cache.IsUploadName(name) {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%q is an upload, not a blob", name)
+	}
+	digest, err := cache.ParseResourceName(name)
+	if err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	var b bytes.Buffer
+	err = t.Get(digest, &b)
+	if err == cache.ErrNotFound {
+		return nil, grpc.Errorf(codes.NotFound, "%s not found", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b.Bytes()), nil
+}
+
+func (t *TieredCache) Abort(ctx context.Context, name string) error {
+	v, ok := t.uploads.Load(name)
+	if !ok {
+		return nil
+	}
+	t.uploads.Delete(name)
+	f, ok := v.(*os.File)
+	if !ok {
+		return fmt.Errorf("type assertion")
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// Close writes a finished, verified bytestream upload through to every
+// tier. Readers need no cleanup, and closing one never commits an upload
+// of the same blob.
+func (t *TieredCache) Close(ctx context.Context, name string) error {
+	if !cache.IsUploadName(name) {
+		return nil
+	}
+	v, ok := t.uploads.Load(name)
+	if !ok {
+		return nil
+	}
+	t.uploads.Delete(name)
+	f, ok := v.(*os.File)
+	if !ok {
+		return fmt.Errorf("type assertion")
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	digest, err := cache.ParseResourceName(name)
+	if err != nil {
+		return err
+	}
+	return t.put(digest, f, cache.Cache.Put)
+}
@@ -0,0 +1,82 @@
+package tiered_cache
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/r2d4/bazel-remote-execution-go/server/cache"
+	"github.com/r2d4/bazel-remote-execution-go/server/cache/memory_cache"
+
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestUploadsAndReads(t *testing.T) {
+	ctx := context.Background()
+	data := "hello"
+	d := &pb.Digest{Hash: "aa", SizeBytes: int64(len(data))}
+	name := fmt.Sprintf("instance/blobs/%s/%d", d.Hash, d.SizeBytes)
+	upload := fmt.Sprintf("instance/uploads/0f4a3c9e/blobs/%s/%d", d.Hash, d.SizeBytes)
+	fast, slow := memory_cache.NewMemoryCache(1<<10), memory_cache.NewMemoryCache(1<<10)
+	tc := NewTieredCache(fast, slow)
+
+	if _, err := tc.GetWriter(ctx, name, 0); err == nil {
+		t.Errorf("GetWriter(%s) succeeded", name)
+	}
+	w, err := tc.GetWriter(ctx, upload, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hex"))
+	// A resumed upload continues at the offset it is given.
+	if w, err = tc.GetWriter(ctx, upload, 2); err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("llo"))
+	if _, err := tc.GetReader(ctx, upload); grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("GetReader(%s) = %v, want InvalidArgument", upload, err)
+	}
+
+	// Closing the blob name is the end of a read and commits nothing.
+	if err := tc.Close(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tc.GetReader(ctx, name); grpc.Code(err) != codes.NotFound {
+		t.Errorf("GetReader(%s) before the upload finished = %v, want NotFound", name, err)
+	}
+
+	if err := tc.Close(ctx, upload); err != nil {
+		t.Fatal(err)
+	}
+	for i, tier := range []cache.Cache{fast, slow} {
+		var b bytes.Buffer
+		if err := tier.Get(d, &b); err != nil || b.String() != data {
+			t.Errorf("tier %d holds %q, %v, want %q", i, b.String(), err, data)
+		}
+	}
+}
+
+func TestAbort(t *testing.T) {
+	ctx := context.Background()
+	d := &pb.Digest{Hash: "aa", SizeBytes: 5}
+	upload := fmt.Sprintf("uploads/0f4a3c9e/blobs/%s/%d", d.Hash, d.SizeBytes)
+	tc := NewTieredCache(memory_cache.NewMemoryCache(1 << 10))
+	w, err := tc.GetWriter(ctx, upload, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hello"))
+	if err := tc.Abort(ctx, upload); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Close(ctx, upload); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := tc.Contains(d); ok {
+		t.Error("aborted upload was stored")
+	}
+}
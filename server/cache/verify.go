@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/r2d4/bazel-remote-execution-go/server/digest"
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+)
+
+// DigestMismatchError is returned when uploaded data does not match the
+// digest it was uploaded under.
+type DigestMismatchError struct {
+	Expected  *pb.Digest
+	Hash      string
+	SizeBytes int64
+}
+
+func (e *DigestMismatchError) Error() string {
+	if e.Hash == "" {
+		return fmt.Sprintf("digest mismatch: expected %s/%d, got more than %d bytes", e.Expected.Hash, e.Expected.SizeBytes, e.Expected.SizeBytes)
+	}
+	return fmt.Sprintf("digest mismatch: expected %s/%d, got %s/%d", e.Expected.Hash, e.Expected.SizeBytes, e.Hash, e.SizeBytes)
+}
+
+// Verifier hashes data written to it with a digest function and checks it
+// against a digest.
+type Verifier struct {
+	digest *pb.Digest
+	h      hash.Hash
+	n      int64
+}
+
+func NewVerifier(fn *digest.Function, d *pb.Digest) *Verifier {
+	return &Verifier{
+		digest: d,
+		h:      fn.New(),
+	}
+}
+
+// Write fails as soon as more data than the expected size has been written.
+func (v *Verifier) Write(p []byte) (int, error) {
+	v.n += int64(len(p))
+	if v.n > v.digest.SizeBytes {
+		return 0, &DigestMismatchError{Expected: v.digest}
+	}
+	return v.h.Write(p)
+}
+
+// Verify checks the data written so far against the expected digest.
+func (v *Verifier) Verify() error {
+	hash := fmt.Sprintf("%x", v.h.Sum(nil))
+	if v.n != v.digest.SizeBytes || hash != v.digest.Hash {
+		return &DigestMismatchError{
+			Expected:  v.digest,
+			Hash:      hash,
+			SizeBytes: v.n,
+		}
+	}
+	return nil
+}
+
+// Reset discards the data written so far.
+func (v *Verifier) Reset() {
+	v.h.Reset()
+	v.n = 0
+}
+
+// NewVerifyingReader returns a reader that yields the data of r, but returns
+// a *DigestMismatchError instead of io.EOF if the data does not match d.
+// Backends only commit data once they have read it to io.EOF, so mismatched
+// data is never stored.
+func NewVerifyingReader(r io.Reader, fn *digest.Function, d *pb.Digest) io.Reader {
+	return &verifyingReader{
+		r: r,
+		v: NewVerifier(fn, d),
+	}
+}
+
+type verifyingReader struct {
+	r io.Reader
+	v *Verifier
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if _, verr := r.v.Write(p[:n]); verr != nil {
+			return n, verr
+		}
+	}
+	if err == io.EOF {
+		if verr := r.v.Verify(); verr != nil {
+			return n, verr
+		}
+	}
+	return n, err
+}
@@ -2,28 +2,42 @@ package cas
 
 import (
 	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 
 	"golang.org/x/net/context"
 
 	"golang.org/x/sync/errgroup"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/r2d4/bazel-remote-execution-go/server/cache"
+	"github.com/r2d4/bazel-remote-execution-go/server/digest"
 	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/genproto/googleapis/rpc/status"
 	watcher "google.golang.org/genproto/googleapis/watcher/v1"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 )
 
 type CASSrv struct {
-	Cache   cache.Cache
-	CASChan chan watcher.Change
+	Cache          cache.Cache
+	DigestFunction *digest.Function
+	CASChan        chan watcher.Change
 }
 
 // FindMissingBlobs implements ContentAddressableStorage.FindMissingBlobs
 func (s *CASSrv) FindMissingBlobs(ctx context.Context, in *pb.FindMissingBlobsRequest) (*pb.FindMissingBlobsResponse, error) {
 	logrus.Infof("[FindMissingBlobs] %+v", in)
+	for _, d := range in.BlobDigests {
+		if err := s.DigestFunction.Validate(d); err != nil {
+			return nil, grpc.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	}
 	missingBlobs := make(chan *pb.Digest, len(in.BlobDigests))
 	var g errgroup.Group
 	for _, req := range in.BlobDigests {
@@ -31,13 +45,13 @@ func (s *CASSrv) FindMissingBlobs(ctx context.Context, in *pb.FindMissingBlobsRe
 		g.Go(func() error {
 			contains, err := s.Cache.Contains(req)
 			if err != nil {
-				logrus.Info("error %s", err)
+				logrus.Infof("error %s", err)
 				return err
 			}
 			if !contains {
 				logrus.Infof("missing %v", req)
 				missingBlobs <- req
-				logrus.Infof("sent to %v to missingBlobs, new size %d", len(missingBlobs))
+				logrus.Infof("sent %v to missingBlobs, new size %d", req, len(missingBlobs))
 				return nil
 			}
 			return nil
@@ -62,34 +76,210 @@ func (s *CASSrv) FindMissingBlobs(ctx context.Context, in *pb.FindMissingBlobsRe
 // BatchUpdateBlobs implements .BatchUpdateBlobs
 func (s *CASSrv) BatchUpdateBlobs(ctx context.Context, in *pb.BatchUpdateBlobsRequest) (*pb.BatchUpdateBlobsResponse, error) {
 	logrus.Infof("[BatchUpdateBlobs] %+v", in)
-	var g errgroup.Group
-	for _, req := range in.Requests {
-		req := req
-		g.Go(func() error {
-			b := bytes.NewBuffer(req.Data)
-			if err := s.Cache.Put(req.ContentDigest, b); err != nil {
-				return err
-			}
-			any, err := ptypes.MarshalAny(req)
-			if err != nil {
-				return err
-			}
-			s.CASChan <- watcher.Change{
-				Element: req.ContentDigest.Hash,
-				State:   watcher.Change_EXISTS,
-				Data:    any,
+	responses := make([]*pb.BatchUpdateBlobsResponse_Response, len(in.Requests))
+	var wg sync.WaitGroup
+	for i, req := range in.Requests {
+		wg.Add(1)
+		go func(i int, req *pb.UpdateBlobRequest) {
+			defer wg.Done()
+			responses[i] = &pb.BatchUpdateBlobsResponse_Response{
+				BlobDigest: req.ContentDigest,
+				Status:     s.updateBlob(req),
 			}
-			return nil
-		})
+		}(i, req)
 	}
-	if err := g.Wait(); err != nil {
-		return nil, grpc.Errorf(codes.Internal, "writing cas: %v", err)
+	wg.Wait()
+	return &pb.BatchUpdateBlobsResponse{
+		Responses: responses,
+	}, nil
+}
+
+// updateBlob stores a single blob, verifying its contents against its digest.
+func (s *CASSrv) updateBlob(req *pb.UpdateBlobRequest) *status.Status {
+	if err := s.DigestFunction.Validate(req.ContentDigest); err != nil {
+		return &status.Status{
+			Code:    int32(codes.InvalidArgument),
+			Message: err.Error(),
+		}
+	}
+	r := cache.NewVerifyingReader(bytes.NewReader(req.Data), s.DigestFunction, req.ContentDigest)
+	if err := s.Cache.Put(req.ContentDigest, r); err != nil {
+		code := codes.Internal
+		if _, ok := err.(*cache.DigestMismatchError); ok {
+			code = codes.InvalidArgument
+		}
+		return &status.Status{
+			Code:    int32(code),
+			Message: err.Error(),
+		}
+	}
+	any, err := ptypes.MarshalAny(req)
+	if err != nil {
+		return &status.Status{
+			Code:    int32(codes.Internal),
+			Message: err.Error(),
+		}
+	}
+	s.CASChan <- watcher.Change{
+		Element: req.ContentDigest.Hash,
+		State:   watcher.Change_EXISTS,
+		Data:    any,
 	}
-	return &pb.BatchUpdateBlobsResponse{}, nil
+	return &status.Status{Code: int32(codes.OK)}
 }
 
-// GetTree is deprecated
+// GetTree implements ContentAddressableStorage.GetTree. Directories are
+// returned breadth first, page_size at a time.
 func (s *CASSrv) GetTree(ctx context.Context, in *pb.GetTreeRequest) (*pb.GetTreeResponse, error) {
 	logrus.Infof("[GetTree] %+v", in)
-	return nil, nil
+	if err := s.DigestFunction.Validate(in.RootDigest); err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	dirs, next, err := s.TreePage(in.RootDigest, in.PageToken, int(in.PageSize))
+	if err != nil {
+		return nil, err
+	}
+	return &pb.GetTreeResponse{
+		Directories:   dirs,
+		NextPageToken: next,
+	}, nil
+}
+
+// DefaultTreePageSize is the number of directories returned per GetTree
+// page when the client does not ask for a page size.
+const DefaultTreePageSize = 1000
+
+// TreePage returns up to pageSize directories of the tree under root,
+// breadth first, continuing from the page token of an earlier page. The
+// token returned for the next page holds the directories still to visit
+// and those already returned, so each page only reads the directories it
+// returns, directories that appear under several paths are only returned
+// once across all pages, and it is empty once the walk is done. A missing
+// directory is reported as codes.NotFound.
+func (s *CASSrv) TreePage(root *pb.Digest, token string, pageSize int) ([]*pb.Directory, string, error) {
+	if pageSize <= 0 {
+		pageSize = DefaultTreePageSize
+	}
+	queue := []*pb.Digest{root}
+	var visited []*pb.Digest
+	if token != "" {
+		var err error
+		if queue, visited, err = s.parsePageToken(token); err != nil {
+			return nil, "", grpc.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	}
+	seen := map[string]bool{}
+	for _, d := range append(queue, visited...) {
+		seen[digestKey(d)] = true
+	}
+
+	var dirs []*pb.Directory
+	for len(queue) > 0 && len(dirs) < pageSize {
+		d := queue[0]
+		queue = queue[1:]
+		dir, err := s.getDirectory(d)
+		if err != nil {
+			return nil, "", err
+		}
+		dirs = append(dirs, dir)
+		visited = append(visited, d)
+		for _, child := range dir.Directories {
+			key := digestKey(child.Digest)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			queue = append(queue, child.Digest)
+		}
+	}
+	if len(queue) == 0 {
+		return dirs, "", nil
+	}
+	return dirs, pageToken(queue, visited), nil
+}
+
+// getDirectory reads the Directory stored under d, checking the digests of
+// its subdirectories so that walking on from it cannot fail on them.
+func (s *CASSrv) getDirectory(d *pb.Digest) (*pb.Directory, error) {
+	key := digestKey(d)
+	var b bytes.Buffer
+	err := s.Cache.Get(d, &b)
+	if err == cache.ErrNotFound {
+		return nil, grpc.Errorf(codes.NotFound, "directory %s not found", key)
+	}
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal, "getting directory %s: %v", key, err)
+	}
+	dir := &pb.Directory{}
+	if err := proto.Unmarshal(b.Bytes(), dir); err != nil {
+		return nil, grpc.Errorf(codes.Internal, "decoding directory %s: %v", key, err)
+	}
+	for _, child := range dir.Directories {
+		if err := s.DigestFunction.Validate(child.Digest); err != nil {
+			return nil, grpc.Errorf(codes.InvalidArgument, "directory %s: subdirectory %s: %v", key, child.Name, err)
+		}
+	}
+	return dir, nil
+}
+
+func digestKey(d *pb.Digest) string {
+	return fmt.Sprintf("%s/%d", d.Hash, d.SizeBytes)
+}
+
+// pageToken encodes the directories left to visit and those already
+// returned as a GetTree page token.
+func pageToken(queue, visited []*pb.Digest) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(digestKeys(queue) + ";" + digestKeys(visited)))
+}
+
+func digestKeys(ds []*pb.Digest) string {
+	keys := make([]string, len(ds))
+	for i, d := range ds {
+		keys[i] = digestKey(d)
+	}
+	return strings.Join(keys, ",")
+}
+
+// parsePageToken returns the directories left to visit and those already
+// returned encoded in a GetTree page token.
+func (s *CASSrv) parsePageToken(token string) (queue, visited []*pb.Digest, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid page_token %q", token)
+	}
+	parts := strings.Split(string(b), ";")
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, nil, fmt.Errorf("invalid page_token %q", token)
+	}
+	if queue, err = s.parseDigestKeys(parts[0]); err != nil {
+		return nil, nil, fmt.Errorf("invalid page_token %q: %v", token, err)
+	}
+	if parts[1] == "" {
+		return queue, nil, nil
+	}
+	if visited, err = s.parseDigestKeys(parts[1]); err != nil {
+		return nil, nil, fmt.Errorf("invalid page_token %q: %v", token, err)
+	}
+	return queue, visited, nil
+}
+
+// parseDigestKeys parses a comma separated list of digestKeys.
+func (s *CASSrv) parseDigestKeys(keys string) ([]*pb.Digest, error) {
+	var ds []*pb.Digest
+	for _, key := range strings.Split(keys, ",") {
+		i := strings.LastIndex(key, "/")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid digest %q", key)
+		}
+		size, err := strconv.ParseInt(key[i+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid digest %q", key)
+		}
+		d := &pb.Digest{Hash: key[:i], SizeBytes: size}
+		if err := s.DigestFunction.Validate(d); err != nil {
+			return nil, err
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
 }
@@ -0,0 +1,209 @@
+package cas
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/r2d4/bazel-remote-execution-go/server/cache/memory_cache"
+	"github.com/r2d4/bazel-remote-execution-go/server/digest"
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func newTestCAS() *CASSrv {
+	return &CASSrv{
+		Cache:          memory_cache.NewMemoryCache(1 << 20),
+		DigestFunction: digest.SHA256,
+	}
+}
+
+func putDirectory(t *testing.T, s *CASSrv, dir *pb.Directory) *pb.Digest {
+	b, err := proto.Marshal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := s.DigestFunction.FromBytes(b)
+	if err := s.Cache.Put(d, bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestGetTreePages(t *testing.T) {
+	s := newTestCAS()
+	// root
+	// ├── a
+	// │   └── x (leaf)
+	// ├── b
+	// │   └── y (shared)
+	// └── c
+	//     └── z (shared)
+	leaf := &pb.Directory{Files: []*pb.FileNode{{Name: "leaf", Digest: digest.SHA256.FromBytes(nil)}}}
+	shared := &pb.Directory{Files: []*pb.FileNode{{Name: "shared", Digest: digest.SHA256.FromBytes(nil)}}}
+	a := &pb.Directory{Directories: []*pb.DirectoryNode{{Name: "x", Digest: putDirectory(t, s, leaf)}}}
+	b := &pb.Directory{Directories: []*pb.DirectoryNode{{Name: "y", Digest: putDirectory(t, s, shared)}}}
+	c := &pb.Directory{Directories: []*pb.DirectoryNode{{Name: "z", Digest: putDirectory(t, s, shared)}}}
+	root := &pb.Directory{Directories: []*pb.DirectoryNode{
+		{Name: "a", Digest: putDirectory(t, s, a)},
+		{Name: "b", Digest: putDirectory(t, s, b)},
+		{Name: "c", Digest: putDirectory(t, s, c)},
+	}}
+	rootDigest := putDirectory(t, s, root)
+	want := []*pb.Directory{root, a, b, c, leaf, shared}
+
+	for _, c := range []struct {
+		pageSize  int32
+		wantPages int
+	}{
+		{pageSize: 0, wantPages: 1},
+		{pageSize: 1, wantPages: 6},
+		{pageSize: 2, wantPages: 3},
+		{pageSize: 4, wantPages: 2},
+		{pageSize: 6, wantPages: 1},
+		{pageSize: 100, wantPages: 1},
+	} {
+		var got []*pb.Directory
+		pages := 0
+		token := ""
+		for {
+			res, err := s.GetTree(context.Background(), &pb.GetTreeRequest{
+				RootDigest: rootDigest,
+				PageSize:   c.pageSize,
+				PageToken:  token,
+			})
+			if err != nil {
+				t.Fatalf("page size %d: GetTree() = %v", c.pageSize, err)
+			}
+			pages++
+			got = append(got, res.Directories...)
+			if token = res.NextPageToken; token == "" {
+				break
+			}
+			if pages > len(want) {
+				t.Fatalf("page size %d: GetTree() does not end", c.pageSize)
+			}
+		}
+		if pages != c.wantPages {
+			t.Errorf("page size %d: got %d pages, want %d", c.pageSize, pages, c.wantPages)
+		}
+		if len(got) != len(want) {
+			t.Errorf("page size %d: got %d directories, want %d", c.pageSize, len(got), len(want))
+			continue
+		}
+		for i := range want {
+			if !proto.Equal(got[i], want[i]) {
+				t.Errorf("page size %d: directory %d is %v, want %v", c.pageSize, i, got[i], want[i])
+			}
+		}
+	}
+}
+
+func TestGetTreeSharedAcrossPages(t *testing.T) {
+	s := newTestCAS()
+	// root
+	// ├── x (shared)
+	// └── y
+	//     └── z (shared)
+	shared := &pb.Directory{Files: []*pb.FileNode{{Name: "shared", Digest: digest.SHA256.FromBytes(nil)}}}
+	sharedDigest := putDirectory(t, s, shared)
+	y := &pb.Directory{Directories: []*pb.DirectoryNode{{Name: "z", Digest: sharedDigest}}}
+	root := &pb.Directory{Directories: []*pb.DirectoryNode{
+		{Name: "x", Digest: sharedDigest},
+		{Name: "y", Digest: putDirectory(t, s, y)},
+	}}
+	rootDigest := putDirectory(t, s, root)
+	want := []*pb.Directory{root, shared, y}
+
+	for pageSize := int32(1); pageSize <= 3; pageSize++ {
+		var got []*pb.Directory
+		token := ""
+		for {
+			res, err := s.GetTree(context.Background(), &pb.GetTreeRequest{
+				RootDigest: rootDigest,
+				PageSize:   pageSize,
+				PageToken:  token,
+			})
+			if err != nil {
+				t.Fatalf("page size %d: GetTree() = %v", pageSize, err)
+			}
+			got = append(got, res.Directories...)
+			if token = res.NextPageToken; token == "" || len(got) > len(want) {
+				break
+			}
+		}
+		if len(got) != len(want) {
+			t.Errorf("page size %d: got %d directories, want %d", pageSize, len(got), len(want))
+			continue
+		}
+		for i := range want {
+			if !proto.Equal(got[i], want[i]) {
+				t.Errorf("page size %d: directory %d is %v, want %v", pageSize, i, got[i], want[i])
+			}
+		}
+	}
+}
+
+func TestGetTreeErrors(t *testing.T) {
+	s := newTestCAS()
+	missing := digest.SHA256.FromBytes([]byte("not stored"))
+	for _, c := range []struct {
+		desc     string
+		root     *pb.Directory
+		token    string
+		wantCode codes.Code
+	}{
+		{
+			desc:     "subdirectory without a digest",
+			root:     &pb.Directory{Directories: []*pb.DirectoryNode{{Name: "a"}}},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			desc: "subdirectory with a malformed digest",
+			root: &pb.Directory{Directories: []*pb.DirectoryNode{
+				{Name: "a", Digest: &pb.Digest{Hash: "../../etc", SizeBytes: 1}},
+			}},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			desc:     "missing subdirectory",
+			root:     &pb.Directory{Directories: []*pb.DirectoryNode{{Name: "a", Digest: missing}}},
+			wantCode: codes.NotFound,
+		},
+		{
+			desc:     "token that is not base64",
+			root:     &pb.Directory{},
+			token:    "!",
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			desc:     "token with a malformed digest",
+			root:     &pb.Directory{},
+			token:    pageToken([]*pb.Digest{{Hash: "abc", SizeBytes: 1}}, nil),
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			desc:     "token with a malformed visited digest",
+			root:     &pb.Directory{},
+			token:    pageToken([]*pb.Digest{missing}, []*pb.Digest{{Hash: "abc", SizeBytes: 1}}),
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			desc:     "token without directories to visit",
+			root:     &pb.Directory{},
+			token:    pageToken(nil, []*pb.Digest{missing}),
+			wantCode: codes.InvalidArgument,
+		},
+	} {
+		_, err := s.GetTree(context.Background(), &pb.GetTreeRequest{
+			RootDigest: putDirectory(t, s, c.root),
+			PageToken:  c.token,
+		})
+		if got := grpc.Code(err); got != c.wantCode {
+			t.Errorf("%s: GetTree() = %v, want code %s", c.desc, err, c.wantCode)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Package cgroup confines commands to cgroup v2 groups that limit and
+// account for the resources they use.
+package cgroup
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits bounds the resources of a group. Zero values mean no limit.
+type Limits struct {
+	// MemoryBytes is the most memory the group may use before the kernel
+	// kills one of its processes.
+	MemoryBytes int64
+	// CPUs is how many CPUs' worth of time the group may use.
+	CPUs float64
+	// Pids is how many processes and threads the group may hold at once.
+	Pids int64
+}
+
+// Usage is what a group has used so far.
+type Usage struct {
+	// PeakMemoryBytes is the most memory the group used at once, or 0 if
+	// the kernel does not track it.
+	PeakMemoryBytes int64
+	CPUTime         time.Duration
+	// OOMKilled is set if the kernel killed a process of the group for
+	// exceeding its memory limit.
+	OOMKilled bool
+}
+
+// ParseBytes parses a size in bytes with an optional K, M, G or T suffix
+// for powers of 1024, such as "512M".
+func ParseBytes(s string) (int64, error) {
+	shift := uint(0)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		shift = 10
+	case strings.HasSuffix(s, "M"):
+		shift = 20
+	case strings.HasSuffix(s, "G"):
+		shift = 30
+	case strings.HasSuffix(s, "T"):
+		shift = 40
+	}
+	num := s
+	if shift > 0 {
+		num = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)>>shift {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n << shift, nil
+}
+
+// releaseAtLeast reports whether the kernel release, such as
+// "5.15.0-91-generic", is at least major.minor.
+func releaseAtLeast(release string, major, minor int) bool {
+	f := strings.SplitN(release, ".", 3)
+	if len(f) < 2 {
+		return false
+	}
+	maj, err := strconv.Atoi(f[0])
+	if err != nil {
+		return false
+	}
+	min, err := strconv.Atoi(strings.TrimRightFunc(f[1], func(r rune) bool { return r < '0' || r > '9' }))
+	if err != nil {
+		return false
+	}
+	return maj > major || maj == major && min >= minor
+}
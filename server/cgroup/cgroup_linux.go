@@ -0,0 +1,208 @@
+//go:build linux && go1.20
+// +build linux,go1.20
+
+package cgroup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// cgroup2SuperMagic is the file system type of cgroup v2 hierarchies.
+const cgroup2SuperMagic = 0x63677270
+
+// Check reports whether groups can be created under root: root must be a
+// directory of a cgroup v2 hierarchy, and the kernel must be Linux 5.7 or
+// newer, which can start commands directly inside a group.
+func Check(root string) error {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(root, &fs); err != nil {
+		return err
+	}
+	if fs.Type != cgroup2SuperMagic {
+		return fmt.Errorf("%s is not in a cgroup v2 hierarchy", root)
+	}
+	var u syscall.Utsname
+	if err := syscall.Uname(&u); err != nil {
+		return err
+	}
+	var release []byte
+	for _, c := range u.Release {
+		if c == 0 {
+			break
+		}
+		release = append(release, byte(c))
+	}
+	if !releaseAtLeast(string(release), 5, 7) {
+		return fmt.Errorf("starting commands in a cgroup needs Linux 5.7 or newer, this is %s", release)
+	}
+	return nil
+}
+
+// cpuPeriod is the period, in microseconds, over which CPU limits are
+// enforced.
+const cpuPeriod = 100000
+
+// Group is a cgroup v2 group created for a single command.
+type Group struct {
+	path string
+	// fd is an open handle to the group's directory, which commands are
+	// started in.
+	fd int
+}
+
+// New creates the group called name under parent, which must be a
+// directory of a cgroup v2 hierarchy that the server may write to. The
+// memory, cpu and pids controllers are enabled in parent, and New fails if
+// a controller that l needs cannot be. As cgroup v2 only lets groups
+// without processes of their own delegate controllers, parent should not
+// hold the server itself.
+func New(parent, name string, l Limits) (*Group, error) {
+	for controller, needed := range map[string]bool{
+		"memory": l.MemoryBytes > 0,
+		"cpu":    l.CPUs > 0,
+		"pids":   l.Pids > 0,
+	} {
+		err := ioutil.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("+"+controller), 0)
+		if err != nil && needed {
+			return nil, fmt.Errorf("enabling the %s controller in %s: %v", controller, parent, err)
+		}
+	}
+	path := filepath.Join(parent, name)
+	if err := os.Mkdir(path, 0755); err != nil {
+		return nil, err
+	}
+	g := &Group{path: path, fd: -1}
+	if err := g.setLimits(l); err != nil {
+		g.Remove()
+		return nil, err
+	}
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		g.Remove()
+		return nil, err
+	}
+	g.fd = fd
+	return g, nil
+}
+
+func (g *Group) setLimits(l Limits) error {
+	if l.MemoryBytes > 0 {
+		if err := g.write("memory.max", strconv.FormatInt(l.MemoryBytes, 10)); err != nil {
+			return err
+		}
+		// Swapping would only let the command run slowly past its limit.
+		// The file is missing if swap is not accounted for.
+		if err := g.write("memory.swap.max", "0"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if l.CPUs > 0 {
+		quota := int64(l.CPUs * cpuPeriod)
+		if quota < 1000 {
+			quota = 1000
+		}
+		if err := g.write("cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriod)); err != nil {
+			return err
+		}
+	}
+	if l.Pids > 0 {
+		if err := g.write("pids.max", strconv.FormatInt(l.Pids, 10)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Attach makes cmd start inside the group, so that every process it starts
+// is accounted to the group from the outset. This uses CLONE_INTO_CGROUP,
+// which Check makes sure the kernel supports.
+func (g *Group) Attach(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = g.fd
+}
+
+// Usage returns the peak memory and CPU time the group has used and
+// whether it ran out of memory.
+func (g *Group) Usage() (Usage, error) {
+	var u Usage
+	stat, err := g.keyed("cpu.stat")
+	if err != nil {
+		return u, err
+	}
+	u.CPUTime = time.Duration(stat["usage_usec"]) * time.Microsecond
+	events, err := g.keyed("memory.events")
+	if err != nil && !os.IsNotExist(err) {
+		return u, err
+	}
+	u.OOMKilled = events["oom_kill"] > 0
+	// memory.peak needs Linux 5.19.
+	if b, err := ioutil.ReadFile(filepath.Join(g.path, "memory.peak")); err == nil {
+		u.PeakMemoryBytes, _ = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	}
+	return u, nil
+}
+
+// Remove kills whatever is left running in the group and deletes it.
+func (g *Group) Remove() error {
+	if g.fd >= 0 {
+		syscall.Close(g.fd)
+		g.fd = -1
+	}
+	var err error
+	for i := 0; i < 100; i++ {
+		if err = syscall.Rmdir(g.path); err != syscall.EBUSY {
+			break
+		}
+		g.kill()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// kill sends SIGKILL to every process of the group.
+func (g *Group) kill() {
+	// cgroup.kill needs Linux 5.14.
+	if g.write("cgroup.kill", "1") == nil {
+		return
+	}
+	b, _ := ioutil.ReadFile(filepath.Join(g.path, "cgroup.procs"))
+	for _, f := range strings.Fields(string(b)) {
+		if pid, err := strconv.Atoi(f); err == nil {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+}
+
+func (g *Group) write(file, value string) error {
+	return ioutil.WriteFile(filepath.Join(g.path, file), []byte(value), 0)
+}
+
+// keyed reads a file of "key value" lines.
+func (g *Group) keyed(file string) (map[string]int64, error) {
+	b, err := ioutil.ReadFile(filepath.Join(g.path, file))
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]int64{}
+	for _, line := range strings.Split(string(b), "\n") {
+		f := strings.Fields(line)
+		if len(f) == 2 {
+			m[f[0]], _ = strconv.ParseInt(f[1], 10, 64)
+		}
+	}
+	return m, nil
+}
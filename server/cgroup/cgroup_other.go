@@ -0,0 +1,35 @@
+//go:build !linux || !go1.20
+// +build !linux !go1.20
+
+package cgroup
+
+import (
+	"errors"
+	"os/exec"
+)
+
+var errUnsupported = errors.New("cgroup: only supported on linux, built with Go 1.20 or newer")
+
+// Check fails, as groups are not supported outside of Linux or when built
+// with a Go older than 1.20, which cannot start commands in a group.
+func Check(root string) error {
+	return errUnsupported
+}
+
+// Group is not supported.
+type Group struct{}
+
+// New is not supported.
+func New(parent, name string, l Limits) (*Group, error) {
+	return nil, errUnsupported
+}
+
+func (g *Group) Attach(cmd *exec.Cmd) {}
+
+func (g *Group) Usage() (Usage, error) {
+	return Usage{}, errUnsupported
+}
+
+func (g *Group) Remove() error {
+	return nil
+}
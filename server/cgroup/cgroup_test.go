@@ -0,0 +1,57 @@
+package cgroup
+
+import "testing"
+
+func TestParseBytes(t *testing.T) {
+	for _, c := range []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "0", want: 0},
+		{in: "512", want: 512},
+		{in: "1K", want: 1 << 10},
+		{in: "512M", want: 512 << 20},
+		{in: "4G", want: 4 << 30},
+		{in: "2T", want: 2 << 40},
+		{in: "8388607T", want: 8388607 << 40},
+		{in: "8388608T", wantErr: true},
+		{in: "", wantErr: true},
+		{in: "G", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "1.5G", wantErr: true},
+		{in: "1g", wantErr: true},
+		{in: "1GB", wantErr: true},
+	} {
+		got, err := ParseBytes(c.in)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("ParseBytes(%q) = %d, want an error", c.in, got)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("ParseBytes(%q) = %d, %v, want %d", c.in, got, err, c.want)
+		}
+	}
+}
+
+func TestReleaseAtLeast(t *testing.T) {
+	for _, c := range []struct {
+		release string
+		want    bool
+	}{
+		{release: "5.7.0", want: true},
+		{release: "5.15.0-91-generic", want: true},
+		{release: "6.1", want: true},
+		{release: "5.10+", want: true},
+		{release: "5.6.19", want: false},
+		{release: "4.19.0-25-amd64", want: false},
+		{release: "5", want: false},
+		{release: "", want: false},
+	} {
+		if got := releaseAtLeast(c.release, 5, 7); got != c.want {
+			t.Errorf("releaseAtLeast(%q, 5, 7) = %t, want %t", c.release, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package digest
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"lukechampine.com/blake3"
+
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+)
+
+// Function is a hash function used to compute the digests of blobs.
+type Function struct {
+	Name string
+	// Size is the length of a hash in bytes.
+	Size int
+	New  func() hash.Hash
+}
+
+var (
+	SHA1 = &Function{
+		Name: "sha1",
+		Size: sha1.Size,
+		New:  sha1.New,
+	}
+	SHA256 = &Function{
+		Name: "sha256",
+		Size: sha256.Size,
+		New:  sha256.New,
+	}
+	BLAKE3 = &Function{
+		Name: "blake3",
+		Size: 32,
+		New:  func() hash.Hash { return blake3.New(32, nil) },
+	}
+
+	functions = []*Function{SHA1, SHA256, BLAKE3}
+)
+
+// FromName returns the digest function called name, e.g. "sha256".
+func FromName(name string) (*Function, error) {
+	var names []string
+	for _, f := range functions {
+		if strings.EqualFold(f.Name, name) {
+			return f, nil
+		}
+		names = append(names, f.Name)
+	}
+	return nil, fmt.Errorf("unknown digest function %q, expected one of %s", name, strings.Join(names, ", "))
+}
+
+// Validate checks that d is well formed and was computed with f, so that
+// digests from a different function are rejected instead of silently missing.
+func (f *Function) Validate(d *pb.Digest) error {
+	if d == nil {
+		return fmt.Errorf("missing digest")
+	}
+	if d.SizeBytes < 0 {
+		return fmt.Errorf("digest %s/%d has a negative size", d.Hash, d.SizeBytes)
+	}
+	if len(d.Hash) != hex.EncodedLen(f.Size) {
+		return fmt.Errorf("digest %s/%d is not a %s hash: expected %d hex characters, got %d",
+			d.Hash, d.SizeBytes, f.Name, hex.EncodedLen(f.Size), len(d.Hash))
+	}
+	for _, c := range d.Hash {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return fmt.Errorf("digest %s/%d is not a lowercase hex string", d.Hash, d.SizeBytes)
+		}
+	}
+	return nil
+}
+
+// FromReader computes the digest of everything read from r.
+func (f *Function) FromReader(r io.Reader) (*pb.Digest, error) {
+	h := f.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.Digest{
+		SizeBytes: n,
+		Hash:      fmt.Sprintf("%x", h.Sum(nil)),
+	}, nil
+}
+
+// FromBytes computes the digest of b.
+func (f *Function) FromBytes(b []byte) *pb.Digest {
+	d, _ := f.FromReader(bytes.NewReader(b))
+	return d
+}
+
+// FromFile computes the digest of the file at path.
+func (f *Function) FromFile(path string) (*pb.Digest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return f.FromReader(file)
+}
@@ -0,0 +1,77 @@
+package execution
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// validateEnvironment rejects commands whose environment could not be passed
+// to the process exactly as described.
+func validateEnvironment(c *pb.Command) error {
+	seen := map[string]bool{}
+	for _, v := range c.EnvironmentVariables {
+		if v.Name == "" || strings.ContainsAny(v.Name, "=\x00") {
+			return grpc.Errorf(codes.InvalidArgument, "invalid environment variable name %q", v.Name)
+		}
+		if strings.ContainsRune(v.Value, 0) {
+			return grpc.Errorf(codes.InvalidArgument, "environment variable %s contains a NUL byte", v.Name)
+		}
+		if seen[v.Name] {
+			return grpc.Errorf(codes.InvalidArgument, "duplicate environment variable %s", v.Name)
+		}
+		seen[v.Name] = true
+	}
+	return nil
+}
+
+// environment returns the environment of c: its own variables, plus those
+// of the server named in EnvAllowlist that c does not set itself.
+func (s *ExecutionSrv) environment(c *pb.Command) []string {
+	// Not nil, which would make exec pass on the server's environment.
+	env := []string{}
+	set := map[string]bool{}
+	for _, v := range c.EnvironmentVariables {
+		env = append(env, v.Name+"="+v.Value)
+		set[v.Name] = true
+	}
+	for _, name := range s.EnvAllowlist {
+		if set[name] {
+			continue
+		}
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
+
+// lookPath finds name like exec.LookPath does, but in the PATH of the
+// command instead of the server's. Relative entries of path are relative to
+// dir, the working directory of the command.
+func lookPath(name string, env []string, dir string) (string, error) {
+	if strings.Contains(name, "/") {
+		return name, nil
+	}
+	var path string
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "PATH=") {
+			path = strings.TrimPrefix(kv, "PATH=")
+		}
+	}
+	for _, d := range filepath.SplitList(path) {
+		p := filepath.Join(d, name)
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(dir, p)
+		}
+		if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() && fi.Mode()&0111 != 0 {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("%s not found in PATH %q", name, path)
+}
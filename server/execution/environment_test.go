@@ -0,0 +1,66 @@
+package execution
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+)
+
+func TestEnvironment(t *testing.T) {
+	for name, value := range map[string]string{
+		"EXECUTION_TEST_HOME":  "/home/server",
+		"EXECUTION_TEST_EMPTY": "",
+	} {
+		old, ok := os.LookupEnv(name)
+		os.Setenv(name, value)
+		defer func(name string) {
+			if ok {
+				os.Setenv(name, old)
+			} else {
+				os.Unsetenv(name)
+			}
+		}(name)
+	}
+	os.Unsetenv("EXECUTION_TEST_UNSET")
+
+	for _, c := range []struct {
+		desc      string
+		allowlist []string
+		vars      []*pb.Command_EnvironmentVariable
+		want      []string
+	}{
+		{
+			desc: "nothing",
+			want: []string{},
+		},
+		{
+			desc: "command variables only",
+			vars: []*pb.Command_EnvironmentVariable{{Name: "PATH", Value: "/bin"}},
+			want: []string{"PATH=/bin"},
+		},
+		{
+			desc:      "server variables are not passed on unless allowed",
+			allowlist: []string{"EXECUTION_TEST_EMPTY"},
+			want:      []string{"EXECUTION_TEST_EMPTY="},
+		},
+		{
+			desc:      "allowed variables the server does not set",
+			allowlist: []string{"EXECUTION_TEST_UNSET", "EXECUTION_TEST_HOME"},
+			want:      []string{"EXECUTION_TEST_HOME=/home/server"},
+		},
+		{
+			desc:      "command variables win",
+			allowlist: []string{"EXECUTION_TEST_HOME"},
+			vars:      []*pb.Command_EnvironmentVariable{{Name: "EXECUTION_TEST_HOME", Value: "/home/action"}},
+			want:      []string{"EXECUTION_TEST_HOME=/home/action"},
+		},
+	} {
+		s := &ExecutionSrv{EnvAllowlist: c.allowlist}
+		got := s.environment(&pb.Command{EnvironmentVariables: c.vars})
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: environment() = %q, want %q", c.desc, got, c.want)
+		}
+	}
+}
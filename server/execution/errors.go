@@ -0,0 +1,109 @@
+package execution
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+// missingBlobs collects the inputs of an action that are not in the CAS.
+type missingBlobs []*pb.Digest
+
+func (m *missingBlobs) add(d *pb.Digest) {
+	*m = append(*m, d)
+}
+
+// err returns a FailedPrecondition error listing the missing blobs as
+// violations of type MISSING, which tells clients to upload them and retry,
+// or nil if no blob is missing.
+func (m missingBlobs) err() error {
+	if len(m) == 0 {
+		return nil
+	}
+	failure := &errdetails.PreconditionFailure{}
+	for _, d := range m {
+		failure.Violations = append(failure.Violations, &errdetails.PreconditionFailure_Violation{
+			Type:    "MISSING",
+			Subject: fmt.Sprintf("blobs/%s/%d", d.Hash, d.SizeBytes),
+		})
+	}
+	st, err := grpcstatus.New(codes.FailedPrecondition, fmt.Sprintf("%d inputs missing from the CAS", len(m))).WithDetails(failure)
+	if err != nil {
+		return grpc.Errorf(codes.Internal, "%v", err)
+	}
+	return st.Err()
+}
+
+// outOfMemory returns a ResourceExhausted error for a command that the
+// kernel killed for exceeding its memory limit. A QuotaFailure detail with
+// the subject memory-limit tells it apart from the server running out of
+// resources.
+func outOfMemory(limit int64) error {
+	failure := &errdetails.QuotaFailure{
+		Violations: []*errdetails.QuotaFailure_Violation{{
+			Subject:     memoryLimitProperty,
+			Description: fmt.Sprintf("the command used more than %d bytes of memory", limit),
+		}},
+	}
+	st, err := grpcstatus.New(codes.ResourceExhausted, "command was killed for exceeding its memory limit").WithDetails(failure)
+	if err != nil {
+		return grpc.Errorf(codes.Internal, "%v", err)
+	}
+	return st.Err()
+}
+
+// internalError describes a failure of the server while running an action.
+// Running out of disk space, memory or processes is ResourceExhausted and
+// anything else Internal. Errors that already carry a code are returned as
+// they are.
+func internalError(err error, format string, args ...interface{}) error {
+	if code := grpc.Code(err); code != codes.Unknown {
+		return err
+	}
+	code := codes.Internal
+	if exhausted(err) {
+		code = codes.ResourceExhausted
+	}
+	return grpc.Errorf(code, "%s: %v", fmt.Sprintf(format, args...), err)
+}
+
+// exhausted reports whether err is due to the machine running out of a
+// resource.
+func exhausted(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	case *exec.Error:
+		err = e.Err
+	}
+	switch err {
+	case syscall.ENOSPC, syscall.EDQUOT, syscall.ENOMEM, syscall.EAGAIN, syscall.EMFILE, syscall.ENFILE:
+		return true
+	}
+	return false
+}
+
+// statusFor returns err as the Status of an ExecuteResponse, keeping its
+// details.
+func statusFor(err error) *status.Status {
+	err = internalError(err, "executing action")
+	if st, ok := grpcstatus.FromError(err); ok {
+		return st.Proto()
+	}
+	return &status.Status{
+		Code:    int32(grpc.Code(err)),
+		Message: grpc.ErrorDesc(err),
+	}
+}
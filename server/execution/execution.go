@@ -2,20 +2,29 @@ package execution
 
 import (
 	"bytes"
-	"crypto/sha1"
-	"encoding/gob"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"golang.org/x/net/context"
+	"golang.org/x/sync/syncmap"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
+	"github.com/r2d4/bazel-remote-execution-go/server/action_cache"
 	"github.com/r2d4/bazel-remote-execution-go/server/cache"
+	"github.com/r2d4/bazel-remote-execution-go/server/cgroup"
+	"github.com/r2d4/bazel-remote-execution-go/server/digest"
+	"github.com/r2d4/bazel-remote-execution-go/server/sandbox"
 	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
 	"google.golang.org/genproto/googleapis/longrunning"
 	watcher "google.golang.org/genproto/googleapis/watcher/v1"
@@ -24,7 +33,72 @@ import (
 )
 
 type ExecutionSrv struct {
-	Cache cache.Cache
+	Cache          cache.Cache
+	DigestFunction *digest.Function
+
+	// ExecRootBase is the directory under which each action gets its own
+	// exec root. The system temp directory is used if it is empty.
+	ExecRootBase string
+	// KeepExecRoots leaves exec roots in place after actions finish, for
+	// debugging.
+	KeepExecRoots bool
+	// Sandbox runs commands in Linux namespaces that only expose their exec
+	// root and read-only system directories. Actions get no network unless
+	// their platform has the property network=on.
+	Sandbox bool
+	// EnvAllowlist names variables of the server's own environment that are
+	// passed on to commands that do not set them. Commands otherwise get
+	// exactly the environment they ask for.
+	EnvAllowlist []string
+	// DefaultTimeout limits how long commands of actions without a timeout
+	// may run, and MaxTimeout is the longest timeout an action may ask for.
+	// Zero means no limit.
+	DefaultTimeout time.Duration
+	MaxTimeout     time.Duration
+	// ActionCache, if set, is consulted before running actions and stores
+	// the results of successful ones.
+	ActionCache *action_cache.ActionCacheSrv
+
+	// MaxConcurrentActions is how many actions the server runs at once.
+	// Others wait in a queue. It defaults to the number of CPUs.
+	MaxConcurrentActions int
+	// WorkersOnly leaves all actions to workers that lease them through
+	// the Leases service, instead of also running them on the server.
+	WorkersOnly bool
+	// LeaseDuration is how long a worker may hold on to an action without
+	// renewing its lease. It defaults to DefaultLeaseDuration.
+	LeaseDuration time.Duration
+	// OperationRetention is how long finished operations can still be
+	// looked up. 0 means they are kept until they are deleted.
+	OperationRetention time.Duration
+	// CgroupRoot is a cgroup v2 directory under which each action runs in a
+	// group of its own, limited to ActionLimits or to the lower memory-limit,
+	// cpu-limit or pids-limit its platform sets. Without it actions share
+	// the resources of the server.
+	CgroupRoot   string
+	ActionLimits cgroup.Limits
+	// Platform holds the properties of the machine actions run on, which
+	// workers advertise to the server when leasing actions. The server's
+	// runners only take actions whose platform it satisfies, or any action
+	// if it is nil.
+	Platform *pb.Platform
+	// PlatformRules says how each property of an action's platform is
+	// matched. Properties without a rule must match exactly.
+	PlatformRules map[string]MatchRule
+
+	// Operations of running actions keyed by action digest, and of all
+	// actions that have not been forgotten yet keyed by name.
+	inflight   syncmap.Map
+	operations syncmap.Map
+
+	initQueue sync.Once
+	queue     *queue
+
+	initSweeper sync.Once
+
+	leaseMu sync.Mutex
+	leases  map[string]*activeLease
+	workers map[string]*workerInfo
 
 	ActionChan chan watcher.Change
 	CASChan    chan watcher.Change
@@ -33,280 +107,724 @@ type ExecutionSrv struct {
 // Execute implements remote_execution.Execute
 func (s *ExecutionSrv) Execute(ctx context.Context, in *pb.ExecuteRequest) (*longrunning.Operation, error) {
 	logrus.Infof("[Execute] %+v", in)
+	if in.Action == nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "missing action")
+	}
+	for _, d := range []*pb.Digest{in.Action.CommandDigest, in.Action.InputRootDigest} {
+		if err := s.DigestFunction.Validate(d); err != nil {
+			return nil, grpc.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	}
+	if _, err := s.timeout(in.Action); err != nil {
+		return nil, err
+	}
+	if _, err := s.limits(in.Action); err != nil {
+		return nil, err
+	}
+	op, err := s.Start(ctx, in, ActionOptions{})
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-op.Done():
+	default:
+		go s.publish(op)
+	}
+	logrus.Info("returning long running op")
+	return operationProto(op)
+}
+
+// publish sends the finished operation to whoever watches it. The change
+// is dropped if nobody is receiving, rather than blocking forever.
+func (s *ExecutionSrv) publish(op *Operation) {
+	<-op.Done()
+	done, err := operationProto(op)
+	if err != nil {
+		logrus.Warnf("Building operation %s: %s", op.Name, err)
+		return
+	}
+	opAny, err := ptypes.MarshalAny(done)
+	if err != nil {
+		logrus.Warnf("Building operation %s: %s", op.Name, err)
+		return
+	}
+	select {
+	case s.CASChan <- watcher.Change{
+		Element: op.Name,
+		State:   watcher.Change_EXISTS,
+		Data:    opAny,
+	}:
+	default:
+		logrus.Debugf("Nobody watches operation %s", op.Name)
+	}
+}
+
+// operationProto returns the current state of op.
+func operationProto(op *Operation) (*longrunning.Operation, error) {
 	meta := &pb.ExecuteOperationMetadata{
-		Stage:            pb.ExecuteOperationMetadata_QUEUED,
-		ActionDigest:     in.Action.CommandDigest,
-		StdoutStreamName: fmt.Sprintf("%s-stdout", in.Action.CommandDigest),
-		StderrStreamName: fmt.Sprintf("%s-stderr", in.Action.CommandDigest),
+		Stage:        op.Stage(),
+		ActionDigest: op.ActionDigest,
+	}
+	if meta.Stage != pb.ExecuteOperationMetadata_COMPLETED {
+		meta.StdoutStreamName = fmt.Sprintf("%s/stdout", op.Name)
+		meta.StderrStreamName = fmt.Sprintf("%s/stderr", op.Name)
 	}
 	m, err := ptypes.MarshalAny(meta)
 	if err != nil {
 		return nil, grpc.Errorf(codes.Internal, "marshalling ExecuteOperationMetadata to protobuf.Any %s", err)
 	}
-	logrus.Info("Downloading input tree")
-	if err := s.DownloadInputTree(ctx, in); err != nil {
-		return nil, err
+	lop := &longrunning.Operation{
+		Name:     op.Name,
+		Metadata: m,
+	}
+	if meta.Stage != pb.ExecuteOperationMetadata_COMPLETED {
+		return lop, nil
+	}
+	respAny, err := ptypes.MarshalAny(op.Response())
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal, "marshalling ExecuteResponse to protobuf.Any %s", err)
 	}
-	logrus.Info("Finished with input tree")
+	lop.Done = true
+	lop.Result = &longrunning.Operation_Response{
+		Response: respAny,
+	}
+	return lop, nil
+}
+
+// ActionOptions holds settings of an action that v1test messages cannot
+// express, for callers of newer API versions.
+type ActionOptions struct {
+	// ActionDigest is the key of the action in the action cache. It is the
+	// digest of in.Action if nil.
+	ActionDigest *pb.Digest
+	// WorkingDirectory is the directory, relative to the exec root, that the
+	// command runs in and that its output paths are relative to.
+	WorkingDirectory string
+}
 
-	cmd, err := s.GetCommand(ctx, in.Action)
+// ExecuteAction runs in.Action like Start and waits for the response.
+func (s *ExecutionSrv) ExecuteAction(ctx context.Context, in *pb.ExecuteRequest, opts ActionOptions) *pb.ExecuteResponse {
+	op, err := s.Start(ctx, in, opts)
 	if err != nil {
-		return nil, err
+		return &pb.ExecuteResponse{Status: statusFor(err)}
 	}
-	logrus.Info(cmd)
+	<-op.Done()
+	return op.Response()
+}
 
-	go func() {
-		ar, err := s.run(cmd, in)
-		if err != nil {
-			logrus.Warnf("Command %s failed: %s", cmd, err)
-			return
-		}
-		meta := &pb.ExecuteOperationMetadata{
-			Stage:        pb.ExecuteOperationMetadata_COMPLETED,
-			ActionDigest: in.Action.CommandDigest,
+// Start returns an operation that finishes with the result of in.Action.
+// Cached results are returned as already finished operations. While an
+// action runs, later calls for the same action follow its operation instead
+// of running it again, unless they skip the cache lookup. The action is
+// only stopped once all of them have cancelled. Actions whose
+// platform no runner or worker satisfies fail with FailedPrecondition.
+// Failures to run the action are reported in the Status of the response.
+func (s *ExecutionSrv) Start(ctx context.Context, in *pb.ExecuteRequest, opts ActionOptions) (*Operation, error) {
+	actionDigest := opts.ActionDigest
+	if actionDigest == nil {
+		var err error
+		if actionDigest, err = s.actionDigest(in.Action); err != nil {
+			return nil, err
 		}
-		m, err := ptypes.MarshalAny(meta)
-		if err != nil {
-			return
+		opts.ActionDigest = actionDigest
+	}
+	s.startSweeper()
+	op := newOperation(actionDigest)
+	if !in.SkipCacheLookup {
+		if res := s.lookupResult(ctx, in.InstanceName, actionDigest); res != nil {
+			op.finish(&pb.ExecuteResponse{
+				Result:       res,
+				CachedResult: true,
+			})
+			s.operations.Store(op.Name, op)
+			return op, nil
 		}
+	}
+	if !s.canRun(in.Action.Platform) {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "no worker has platform %v", in.Action.Platform.GetProperties())
+	}
+	if in.SkipCacheLookup {
+		s.enqueue(op, in, opts, "")
+		return op, nil
+	}
+	key := fmt.Sprintf("%s/%d", actionDigest.Hash, actionDigest.SizeBytes)
+	v, loaded := s.inflight.LoadOrStore(key, op)
+	if !loaded {
+		s.enqueue(op, in, opts, key)
+		return op, nil
+	}
+	running := v.(*Operation)
+	if !running.join() {
+		// Everybody waiting for it gave up while we looked it up.
+		s.enqueue(op, in, opts, "")
+		return op, nil
+	}
+	logrus.Infof("Action %s is already running as %s", actionDigest.Hash, running.Name)
+	op.follow(running)
+	s.operations.Store(op.Name, op)
+	return op, nil
+}
 
-		resp := &pb.ExecuteResponse{
-			Result: ar,
+// enqueue queues in.Action to be run by a runner or worker, finishing op
+// with the response. key is where op is registered as in flight, if
+// anywhere.
+func (s *ExecutionSrv) enqueue(op *Operation, in *pb.ExecuteRequest, opts ActionOptions, key string) {
+	q := s.jobQueue()
+	// The operation may outlive the RPC that started it.
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{op: op, in: in, opts: opts, key: key, ctx: ctx}
+	op.cancel = func() {
+		cancel()
+		if q.remove(j) {
+			s.finish(j, nil, grpc.Errorf(codes.Canceled, "operation %s was cancelled", op.Name))
 		}
+	}
+	s.operations.Store(op.Name, op)
+	q.push(j)
+}
 
-		respAny, err := ptypes.MarshalAny(resp)
-		if err != nil {
-			logrus.Warn("error: %s", err)
+// jobQueue returns the queue of actions waiting to run, starting the
+// runners that take actions off it on first use.
+func (s *ExecutionSrv) jobQueue() *queue {
+	s.initQueue.Do(func() {
+		s.queue = newQueue()
+		if s.WorkersOnly {
 			return
 		}
-
-		op := &longrunning.Operation{
-			Name:     in.Action.CommandDigest.Hash,
-			Metadata: m,
-			Done:     true,
-			Result: &longrunning.Operation_Response{
-				Response: respAny,
-			},
+		n := s.MaxConcurrentActions
+		if n <= 0 {
+			n = runtime.NumCPU()
 		}
+		for i := 0; i < n; i++ {
+			go s.runner()
+		}
+	})
+	return s.queue
+}
 
-		opAny, err := ptypes.MarshalAny(op)
+// runner runs queued jobs one at a time.
+func (s *ExecutionSrv) runner() {
+	for {
+		j, err := s.queue.pop(context.Background(), s.runsLocally)
 		if err != nil {
 			return
 		}
-		s.CASChan <- watcher.Change{
-			Element: in.Action.CommandDigest.Hash,
-			State:   watcher.Change_EXISTS,
-			Data:    opAny,
-		}
-	}()
+		s.runJob(j)
+	}
+}
 
-	logrus.Info("returning long running op")
-	return &longrunning.Operation{
-		Name:     in.Action.CommandDigest.Hash,
-		Metadata: m,
-	}, nil
+func (s *ExecutionSrv) runJob(j *job) {
+	j.op.setStage(pb.ExecuteOperationMetadata_EXECUTING)
+	res, err := s.Run(j.ctx, j.in, j.opts)
+	if err == nil && j.ctx.Err() != nil {
+		err = grpc.Errorf(codes.Canceled, "operation %s was cancelled", j.op.Name)
+	}
+	s.finish(j, res, err)
 }
 
-func (s *ExecutionSrv) run(c *pb.Command, in *pb.ExecuteRequest) (*pb.ActionResult, error) {
-	outDirs := make([]*pb.OutputDirectory, len(in.Action.OutputDirectories))
-	outFiles := make([]*pb.OutputFile, len(in.Action.OutputFiles))
-	res := &pb.ActionResult{
-		OutputDirectories: outDirs,
-		OutputFiles:       outFiles,
+// finish completes the operation of j with the result of running it.
+func (s *ExecutionSrv) finish(j *job, res *pb.ActionResult, err error) {
+	resp := &pb.ExecuteResponse{Result: res}
+	if err != nil {
+		logrus.Warnf("Action %s failed: %s", j.op.ActionDigest.Hash, err)
+		resp.Status = statusFor(err)
+	} else {
+		s.cacheResult(j.ctx, j.in, j.op.ActionDigest, res)
+	}
+	j.op.finish(resp)
+	if j.key != "" {
+		s.inflight.Delete(j.key)
 	}
-	cmd := exec.Command(c.Arguments[0], c.Arguments[1:]...)
+}
 
-	var stdout, stderr bytes.Buffer
-	cmd.Stderr = &stderr
-	cmd.Stdout = &stdout
+// Operation returns the operation called name, unless it has been
+// forgotten.
+func (s *ExecutionSrv) Operation(name string) (*Operation, bool) {
+	v, ok := s.operations.Load(name)
+	if !ok || s.expired(v.(*Operation)) {
+		return nil, false
+	}
+	return v.(*Operation), true
+}
 
-	if err := cmd.Run(); err != nil {
-		return nil, err
+// expired reports whether op finished longer than OperationRetention ago.
+// Such operations are treated as forgotten until the sweeper removes them.
+func (s *ExecutionSrv) expired(op *Operation) bool {
+	return s.OperationRetention > 0 && op.finishedBefore(time.Now().Add(-s.OperationRetention))
+}
+
+// maxSweepInterval bounds how long expired operations are kept in memory.
+const maxSweepInterval = time.Minute
+
+// startSweeper starts forgetting expired operations in the background, on
+// first use.
+func (s *ExecutionSrv) startSweeper() {
+	if s.OperationRetention <= 0 {
+		return
 	}
-	for i, path := range in.Action.OutputDirectories {
-		digest, err := sha1digest(path)
-		// even IsNotExists is bad here
-		if err != nil {
-			return nil, err
+	s.initSweeper.Do(func() {
+		interval := s.OperationRetention
+		if interval > maxSweepInterval {
+			interval = maxSweepInterval
 		}
-		o := &pb.OutputDirectory{
-			Path:   in.Action.OutputDirectories[i],
-			Digest: digest,
+		go func() {
+			for range time.Tick(interval) {
+				s.expireOperations()
+			}
+		}()
+	})
+}
+
+// expireOperations forgets operations that finished longer than
+// OperationRetention ago.
+func (s *ExecutionSrv) expireOperations() {
+	s.operations.Range(func(k, v interface{}) bool {
+		if s.expired(v.(*Operation)) {
+			s.operations.Delete(k)
 		}
+		return true
+	})
+}
+
+// Run stages the inputs of in.Action, runs its command and waits for the
+// result, bypassing the action cache and the queue. Cancelling ctx kills
+// the command.
+//
+// If the command times out, the error has code DeadlineExceeded and the
+// result holds the output captured up to then.
+func (s *ExecutionSrv) Run(ctx context.Context, in *pb.ExecuteRequest, opts ActionOptions) (*pb.ActionResult, error) {
+	if _, err := s.timeout(in.Action); err != nil {
+		return nil, err
+	}
+	root, err := s.newExecRoot()
+	if err != nil {
+		return nil, internalError(err, "creating exec root")
+	}
+	defer s.removeExecRoot(root)
+	// Report every missing input at once, so that clients can upload them
+	// all before retrying.
+	var missing missingBlobs
+	cmd, err := s.getCommand(in.Action, &missing)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.downloadDirRecursive(ctx, in.Action.InputRootDigest, root, &missing); err != nil {
+		return nil, err
+	}
+	if err := missing.err(); err != nil {
+		return nil, err
+	}
+	return s.runCommand(ctx, cmd, in, root, opts)
+}
 
-		outDirs[i] = o
+// actionDigest returns the digest of a, under which its result is cached.
+func (s *ExecutionSrv) actionDigest(a *pb.Action) (*pb.Digest, error) {
+	b, err := proto.Marshal(a)
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal, "marshalling action: %v", err)
+	}
+	return s.DigestFunction.FromBytes(b), nil
+}
 
-		var b bytes.Buffer
-		enc := gob.NewEncoder(&b)
-		if err := enc.Encode(o); err != nil {
-			return nil, grpc.Errorf(codes.Internal, "%v", err)
+// lookupResult returns the cached result of the action with digest d, or nil.
+func (s *ExecutionSrv) lookupResult(ctx context.Context, instance string, d *pb.Digest) *pb.ActionResult {
+	if s.ActionCache == nil {
+		return nil
+	}
+	res, err := s.ActionCache.GetActionResult(ctx, &pb.GetActionResultRequest{
+		InstanceName: instance,
+		ActionDigest: d,
+	})
+	if err != nil {
+		if grpc.Code(err) != codes.NotFound {
+			logrus.Warnf("Looking up action result %s: %s", d.Hash, err)
 		}
-		if err := s.Cache.Upload(digest, bytes.NewReader(b.Bytes())); err != nil {
-			return nil, err
+		return nil
+	}
+	logrus.Infof("Using cached result for action %s", d.Hash)
+	return res
+}
+
+// cacheResult stores res as the result of in.Action if it succeeded and
+// the action may be cached.
+func (s *ExecutionSrv) cacheResult(ctx context.Context, in *pb.ExecuteRequest, d *pb.Digest, res *pb.ActionResult) {
+	if s.ActionCache == nil || res == nil || res.ExitCode != 0 || in.Action.DoNotCache {
+		return
+	}
+	_, err := s.ActionCache.UpdateActionResult(ctx, &pb.UpdateActionResultRequest{
+		InstanceName: in.InstanceName,
+		ActionDigest: d,
+		ActionResult: res,
+	})
+	if err != nil {
+		logrus.Warnf("Caching action result %s: %s", d.Hash, err)
+	}
+}
+
+// timeout returns how long the command of a may run, or 0 for no limit.
+func (s *ExecutionSrv) timeout(a *pb.Action) (time.Duration, error) {
+	if a.Timeout == nil {
+		return s.DefaultTimeout, nil
+	}
+	d, err := ptypes.Duration(a.Timeout)
+	if err != nil || d < 0 {
+		return 0, grpc.Errorf(codes.InvalidArgument, "invalid timeout %v", a.Timeout)
+	}
+	if d == 0 {
+		return s.DefaultTimeout, nil
+	}
+	if s.MaxTimeout > 0 && d > s.MaxTimeout {
+		return 0, grpc.Errorf(codes.InvalidArgument, "timeout %s is longer than the maximum of %s", d, s.MaxTimeout)
+	}
+	return d, nil
+}
+
+// newExecRoot creates an empty directory, unique to one action, in which its
+// inputs are staged and its command runs.
+func (s *ExecutionSrv) newExecRoot() (string, error) {
+	if s.ExecRootBase != "" {
+		if err := os.MkdirAll(s.ExecRootBase, 0755); err != nil {
+			return "", err
 		}
 	}
-	for i, path := range in.Action.OutputFiles {
-		digest, err := sha1digest(path)
-		// even IsNotExists is bad here
+	root, err := ioutil.TempDir(s.ExecRootBase, "action-")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(root)
+}
+
+func (s *ExecutionSrv) removeExecRoot(root string) {
+	if s.KeepExecRoots {
+		logrus.Infof("Keeping exec root %s", root)
+		return
+	}
+	if err := os.RemoveAll(root); err != nil {
+		logrus.Warnf("Removing exec root %s: %s", root, err)
+	}
+}
+
+// execPath resolves a path relative to the exec root, refusing paths that
+// would point outside of it.
+func execPath(root, p string) (string, error) {
+	clean := filepath.Clean(p)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", grpc.Errorf(codes.InvalidArgument, "path %q is not inside the exec root", p)
+	}
+	return filepath.Join(root, clean), nil
+}
+
+func (s *ExecutionSrv) runCommand(ctx context.Context, c *pb.Command, in *pb.ExecuteRequest, root string, opts ActionOptions) (*pb.ActionResult, error) {
+	res := &pb.ActionResult{}
+	dir, err := execPath(root, opts.WorkingDirectory)
+	if err != nil {
+		return nil, err
+	}
+	// The command expects the parent directories of its outputs to exist.
+	outputs := append(append([]string{}, in.Action.OutputFiles...), in.Action.OutputDirectories...)
+	for _, o := range outputs {
+		p, err := execPath(dir, o)
 		if err != nil {
 			return nil, err
 		}
-		// todo If its small enough just put it in the content field.
-		if digest.SizeBytes < 10<<4 {
-			//
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return nil, internalError(err, "creating parent of output %s", o)
 		}
-		o := &pb.OutputFile{
-			Path:   in.Action.OutputFiles[i],
-			Digest: digest,
+	}
+	if len(c.Arguments) == 0 {
+		return nil, grpc.Errorf(codes.InvalidArgument, "command has no arguments")
+	}
+	env := s.environment(c)
+	var cmd *exec.Cmd
+	if s.Sandbox {
+		// The sandbox looks the command up itself, inside its own root.
+		cmd, err = sandbox.Command(sandbox.Options{
+			ExecRoot:     root,
+			Dir:          dir,
+			AllowNetwork: platformProperty(in.Action.Platform, "network") == "on",
+		}, c.Arguments)
+		if err != nil {
+			return nil, internalError(err, "setting up sandbox")
 		}
-		outFiles[i] = o
-
+	} else {
+		name, err := lookPath(c.Arguments[0], env, dir)
+		if err != nil {
+			return nil, grpc.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		cmd = exec.Command(name, c.Arguments[1:]...)
 	}
-
-	res.ExitCode = 0
-	var b bytes.Buffer
-	enc := gob.NewEncoder(&b)
-	if err := enc.Encode(res); err != nil {
-		return nil, grpc.Errorf(codes.Internal, "%v", err)
+	cmd.Dir = dir
+	cmd.Env = env
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
 	}
+	// Give the command a process group of its own, so that everything it
+	// starts can be killed along with it.
+	cmd.SysProcAttr.Setpgid = true
 
-	h := sha1.New()
-	_, err := h.Write(b.Bytes())
+	var stdout, stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.Stdout = &stdout
+
+	timeout, err := s.timeout(in.Action)
 	if err != nil {
 		return nil, err
 	}
-	actionDigest := &pb.Digest{
-		Hash:      fmt.Sprintf("%x", h.Sum(nil)),
-		SizeBytes: int64(len(b.Bytes())),
+	var group *cgroup.Group
+	limits, err := s.limits(in.Action)
+	if err != nil {
+		return nil, err
 	}
-
-	if err := s.Cache.Upload(actionDigest, bytes.NewReader(b.Bytes())); err != nil {
+	if s.CgroupRoot != "" {
+		if group, err = cgroup.New(s.CgroupRoot, filepath.Base(root), limits); err != nil {
+			return nil, internalError(err, "creating cgroup")
+		}
+		defer func() {
+			if err := group.Remove(); err != nil {
+				logrus.Warnf("Removing cgroup of %s: %s", root, err)
+			}
+		}()
+		group.Attach(cmd)
+	}
+	timedOut, err := runWithTimeout(ctx, cmd, timeout)
+	if err == context.Canceled {
+		return nil, grpc.Errorf(codes.Canceled, "command was cancelled")
+	}
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return nil, internalError(err, "starting command")
+		}
+		res.ExitCode = exitCode(exitErr)
+	}
+	u := usage(cmd, group)
+	recordUsage(opts.ActionDigest, u)
+	if res.StdoutRaw, res.StdoutDigest, err = s.storeOutput(stdout.Bytes()); err != nil {
+		return nil, internalError(err, "storing stdout")
+	}
+	if res.StderrRaw, res.StderrDigest, err = s.storeOutput(stderr.Bytes()); err != nil {
+		return nil, internalError(err, "storing stderr")
+	}
+	if u.OOMKilled && res.ExitCode != 0 {
+		return res, outOfMemory(limits.MemoryBytes)
+	}
+	if timedOut {
+		return res, grpc.Errorf(codes.DeadlineExceeded, "command timed out after %s", timeout)
+	}
+	if err := s.collectOutputs(in, root, dir, res); err != nil {
 		return nil, err
 	}
 
-	logrus.Info("Returning action result for %s: %s", in, res)
+	logrus.Infof("Returning action result for %v: %v", in, res)
 	return res, nil
 }
 
-func sha1digest(path string) (*pb.Digest, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
+// maxInlineOutputBytes is the size up to which stdout, stderr and the
+// contents of output files are returned inline in an ActionResult.
+const maxInlineOutputBytes = 16 << 10
+
+// storeOutput returns data inline if it is small, and otherwise uploads it
+// to the CAS and returns its digest.
+func (s *ExecutionSrv) storeOutput(data []byte) ([]byte, *pb.Digest, error) {
+	if len(data) == 0 {
+		return nil, nil, nil
 	}
-	defer f.Close()
+	if len(data) <= maxInlineOutputBytes {
+		return data, nil, nil
+	}
+	d := s.DigestFunction.FromBytes(data)
+	if err := s.Cache.Put(d, bytes.NewReader(data)); err != nil {
+		return nil, nil, err
+	}
+	return nil, d, nil
+}
 
-	h := sha1.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return nil, err
+// exitCode returns the exit code of a command that failed, using the shell
+// convention of 128 plus the signal number for commands killed by a signal.
+func exitCode(err *exec.ExitError) int32 {
+	ws, ok := err.Sys().(syscall.WaitStatus)
+	if !ok {
+		return 1
+	}
+	if ws.Signaled() {
+		return 128 + int32(ws.Signal())
 	}
+	return int32(ws.ExitStatus())
+}
 
-	fi, err := f.Stat()
-	if err != nil {
-		return nil, err
+// runWithTimeout runs cmd, killing its whole process group if it is still
+// running after timeout or when ctx is done. A zero timeout means no limit.
+func runWithTimeout(ctx context.Context, cmd *exec.Cmd, timeout time.Duration) (timedOut bool, err error) {
+	if err := cmd.Start(); err != nil {
+		return false, err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
 	}
+	select {
+	case err := <-done:
+		return false, err
+	case <-expired:
+		logrus.Infof("Killing process group %d after %s", cmd.Process.Pid, timeout)
+		killGroup(cmd)
+		<-done
+		return true, nil
+	case <-ctx.Done():
+		logrus.Infof("Killing process group %d: %s", cmd.Process.Pid, ctx.Err())
+		killGroup(cmd)
+		<-done
+		return false, ctx.Err()
+	}
+}
 
-	return &pb.Digest{
-		SizeBytes: fi.Size(),
-		Hash:      fmt.Sprintf("%x", h.Sum(nil)),
-	}, nil
+func killGroup(cmd *exec.Cmd) {
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		logrus.Warnf("Killing process group %d: %s", cmd.Process.Pid, err)
+	}
 }
 
 func (s *ExecutionSrv) GetCommand(ctx context.Context, in *pb.Action) (*pb.Command, error) {
+	var missing missingBlobs
+	c, err := s.getCommand(in, &missing)
+	if err != nil {
+		return nil, err
+	}
+	if err := missing.err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// getCommand returns the Command of in, or nil if it is missing from the
+// CAS, in which case it is added to missing.
+func (s *ExecutionSrv) getCommand(in *pb.Action, missing *missingBlobs) (*pb.Command, error) {
 	var b bytes.Buffer
-	if err := s.Cache.Get(in.CommandDigest, &b); err != nil {
-		return nil, grpc.Errorf(codes.Internal, "Error getting CAS dir: %+s", in)
+	err := s.Cache.Get(in.CommandDigest, &b)
+	if err == cache.ErrNotFound {
+		missing.add(in.CommandDigest)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, internalError(err, "getting command %s", in.CommandDigest.Hash)
 	}
 
 	var c pb.Command
 	if err := proto.Unmarshal(b.Bytes(), &c); err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "decoding command %s: %v", in.CommandDigest.Hash, err)
+	}
+	if err := validateEnvironment(&c); err != nil {
 		return nil, err
 	}
 
 	return &c, nil
 }
 
-func (s *ExecutionSrv) DownloadInputTree(ctx context.Context, in *pb.ExecuteRequest) error {
-	//TODO sandbox?
-	outDir, err := os.Getwd()
-	if err != nil {
+// DownloadInputTree stages the input root of in.Action into root.
+func (s *ExecutionSrv) DownloadInputTree(ctx context.Context, in *pb.ExecuteRequest, root string) error {
+	var missing missingBlobs
+	if err := s.downloadDirRecursive(ctx, in.Action.InputRootDigest, root, &missing); err != nil {
 		return err
 	}
-	return s.downloadDirRecursive(ctx, in.Action.InputRootDigest, outDir)
+	return missing.err()
+}
+
+// validName reports whether name is a single path component, so that
+// staging it cannot write outside of its parent directory.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsRune(name, '/')
 }
 
-func (s *ExecutionSrv) downloadDirRecursive(ctx context.Context, in *pb.Digest, dirpath string) error {
+// downloadDirRecursive stages the directory with digest in into dirpath.
+// Blobs missing from the CAS are added to missing and skipped.
+func (s *ExecutionSrv) downloadDirRecursive(ctx context.Context, in *pb.Digest, dirpath string, missing *missingBlobs) error {
+	if err := s.DigestFunction.Validate(in); err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "staging %s: %v", dirpath, err)
+	}
+	if err := os.MkdirAll(dirpath, 0777); err != nil {
+		return internalError(err, "staging inputs")
+	}
 	var b bytes.Buffer
-	if err := s.Cache.Get(in, &b); err != nil {
-		return grpc.Errorf(codes.Internal, "Error getting CAS dir: %+s", in)
+	err := s.Cache.Get(in, &b)
+	if err == cache.ErrNotFound {
+		missing.add(in)
+		return nil
+	}
+	if err != nil {
+		return internalError(err, "getting directory %s", in.Hash)
 	}
 	var dir pb.Directory
 
 	if err := proto.Unmarshal(b.Bytes(), &dir); err != nil {
-		return err
+		return grpc.Errorf(codes.InvalidArgument, "decoding directory %s: %v", in.Hash, err)
 	}
 
 	logrus.Info("downloadDirRecursive:", dir.String())
 	for _, dir := range dir.Directories {
-		if err := s.downloadDirRecursive(ctx, dir.Digest, path.Join(dirpath, dir.Name)); err != nil {
-			return grpc.Errorf(codes.Internal, "error downloading directories: %s", err)
+		if !validName(dir.Name) {
+			return grpc.Errorf(codes.InvalidArgument, "invalid directory name %q", dir.Name)
+		}
+		if err := s.downloadDirRecursive(ctx, dir.Digest, path.Join(dirpath, dir.Name), missing); err != nil {
+			return err
 		}
 	}
 
 	for _, file := range dir.Files {
-		if err := s.downloadFile(ctx, file, dirpath); err != nil {
-			return grpc.Errorf(codes.Internal, "error downloading files: %s", err)
+		if !validName(file.Name) {
+			return grpc.Errorf(codes.InvalidArgument, "invalid file name %q", file.Name)
+		}
+		if err := s.DigestFunction.Validate(file.Digest); err != nil {
+			return grpc.Errorf(codes.InvalidArgument, "input file %s: %v", path.Join(dirpath, file.Name), err)
+		}
+		if err := s.downloadFile(ctx, file, dirpath, missing); err != nil {
+			return internalError(err, "staging input %s", file.Name)
 		}
 	}
 
 	return nil
 }
 
-func (s *ExecutionSrv) downloadFile(ctx context.Context, node *pb.FileNode, dirpath string) error {
+func (s *ExecutionSrv) downloadFile(ctx context.Context, node *pb.FileNode, dirpath string, missing *missingBlobs) error {
 	fpath := path.Join(dirpath, node.Name)
-	if err := os.MkdirAll(dirpath, 0777); err != nil {
-		return nil
-	}
 	if node.Digest.SizeBytes == 0 {
 		logrus.Infof("File %s is empty, creating instead of fetching it", fpath)
 		f, err := os.Create(fpath)
 		if err != nil {
 			return err
 		}
-		defer f.Close()
-		return nil
-	}
-	logrus.Infof("File %s exists locally already", fpath)
-	digest, err := sha1digest(fpath)
-	// If the file exists, check if the hash and size match
-	if err == nil {
-		if node.Digest.Hash == digest.Hash && node.Digest.SizeBytes == digest.SizeBytes {
-			logrus.Infof("File %s already exists locally, skipping", fpath)
-			return nil
+		if err := f.Close(); err != nil {
+			return err
 		}
+		return setMode(fpath, node)
 	}
-	// Some error other than is not exists
-	if err != nil && !os.IsNotExist(err) {
-		return err
-	}
-
 	logrus.Infof("Downloading file %s", fpath)
 
 	f, err := os.Create(fpath)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
-	if err := s.Cache.Get(node.Digest, f); err != nil {
-		return grpc.Errorf(codes.Internal, "Error getting CAS file: %+s", node)
+	err = s.Cache.Get(node.Digest, f)
+	if err == cache.ErrNotFound {
+		missing.add(node.Digest)
+		return nil
+	}
+	if err != nil {
+		return err
 	}
 
-	defer f.Close()
+	return setMode(fpath, node)
+}
 
-	if node.IsExecutable {
-		if err := os.Chmod(fpath, 0777); err != nil {
-			return err
-		}
+// setMode marks the staged file at fpath executable if node asks for it.
+func setMode(fpath string, node *pb.FileNode) error {
+	if !node.IsExecutable {
+		return nil
 	}
-
-	return nil
+	return os.Chmod(fpath, 0777)
 }
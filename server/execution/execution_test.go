@@ -0,0 +1,41 @@
+package execution
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/r2d4/bazel-remote-execution-go/server/cache/memory_cache"
+	"github.com/r2d4/bazel-remote-execution-go/server/digest"
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+)
+
+// newTestServer returns a server that keeps its blobs in memory and leaves
+// all actions to workers, so that tests decide when they run.
+func newTestServer() *ExecutionSrv {
+	return &ExecutionSrv{
+		Cache:          memory_cache.NewMemoryCache(1 << 20),
+		DigestFunction: digest.SHA256,
+		WorkersOnly:    true,
+	}
+}
+
+// testAction stores a command running args and an empty input root, and
+// returns an action running it.
+func testAction(t *testing.T, s *ExecutionSrv, args ...string) *pb.Action {
+	put := func(m proto.Message) *pb.Digest {
+		b, err := proto.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := s.DigestFunction.FromBytes(b)
+		if err := s.Cache.Put(d, bytes.NewReader(b)); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	return &pb.Action{
+		CommandDigest:   put(&pb.Command{Arguments: args}),
+		InputRootDigest: put(&pb.Directory{}),
+	}
+}
@@ -0,0 +1,160 @@
+package execution
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/r2d4/bazel-remote-execution-go/server/lease"
+
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+// DefaultLeaseDuration is how long leases last if LeaseDuration is not set.
+const DefaultLeaseDuration = time.Minute
+
+// activeLease is a job leased to a worker.
+type activeLease struct {
+	job    *job
+	worker string
+	// expiry requeues the job unless the lease is renewed before deadline.
+	expiry   *time.Timer
+	deadline time.Time
+}
+
+// Lease implements Leases.Lease
+func (s *ExecutionSrv) Lease(ctx context.Context, in *lease.LeaseRequest) (*lease.Lease, error) {
+	q := s.jobQueue()
+	defer s.startPolling(in.Worker, in.Platform)()
+	accept := func(j *job) bool { return s.satisfies(in.Platform, j.in.Action.GetPlatform()) }
+	for {
+		j, err := q.pop(ctx, accept)
+		if err != nil {
+			return nil, grpc.Errorf(codes.DeadlineExceeded, "no action queued: %v", err)
+		}
+		l, err := s.leaseProto(j)
+		if err != nil {
+			s.finish(j, nil, err)
+			continue
+		}
+		logrus.Infof("[LEASE] %s to %s", j.op.Name, in.Worker)
+		j.op.setStage(pb.ExecuteOperationMetadata_EXECUTING)
+		a := &activeLease{job: j, worker: in.Worker}
+		s.leaseMu.Lock()
+		if s.leases == nil {
+			s.leases = map[string]*activeLease{}
+		}
+		s.leases[j.op.Name] = a
+		a.deadline = time.Now().Add(s.leaseDuration())
+		a.expiry = time.AfterFunc(s.leaseDuration(), func() { s.expireLease(j.op.Name, a) })
+		s.leaseMu.Unlock()
+		return l, nil
+	}
+}
+
+// Renew implements Leases.Renew
+func (s *ExecutionSrv) Renew(ctx context.Context, in *lease.RenewRequest) (*lease.Lease, error) {
+	s.leaseMu.Lock()
+	s.sawWorker(in.Worker)
+	a, ok := s.leases[in.Name]
+	if ok && a.worker == in.Worker {
+		a.deadline = time.Now().Add(s.leaseDuration())
+		a.expiry.Reset(s.leaseDuration())
+	}
+	s.leaseMu.Unlock()
+	if !ok || a.worker != in.Worker {
+		return nil, grpc.Errorf(codes.NotFound, "%s holds no lease on %s", in.Worker, in.Name)
+	}
+	return s.leaseProto(a.job)
+}
+
+// Complete implements Leases.Complete
+func (s *ExecutionSrv) Complete(ctx context.Context, in *lease.CompleteRequest) (*empty.Empty, error) {
+	failed := in.Status != nil && codes.Code(in.Status.Code) != codes.OK
+	if in.Result == nil && !failed {
+		return nil, grpc.Errorf(codes.InvalidArgument, "completion of %s has neither a result nor an error", in.Name)
+	}
+	a, ok := s.takeLease(in.Name, in.Worker)
+	if !ok {
+		return nil, grpc.Errorf(codes.NotFound, "%s holds no lease on %s", in.Worker, in.Name)
+	}
+	a.expiry.Stop()
+	logrus.Infof("[LEASE] %s completed by %s", in.Name, in.Worker)
+	var err error
+	if failed {
+		err = grpcstatus.ErrorProto(in.Status)
+	}
+	s.finish(a.job, in.Result, err)
+	return &empty.Empty{}, nil
+}
+
+// takeLease ends the lease of worker on the operation called name.
+func (s *ExecutionSrv) takeLease(name, worker string) (*activeLease, bool) {
+	s.leaseMu.Lock()
+	defer s.leaseMu.Unlock()
+	s.sawWorker(worker)
+	a, ok := s.leases[name]
+	if !ok || a.worker != worker {
+		return nil, false
+	}
+	delete(s.leases, name)
+	return a, true
+}
+
+// expireLease queues the job of a lease again once the worker holding it
+// has stopped renewing it, presumably because it died.
+func (s *ExecutionSrv) expireLease(name string, a *activeLease) {
+	s.leaseMu.Lock()
+	if s.leases[name] != a || time.Now().Before(a.deadline) {
+		// Completed or renewed just as the lease expired.
+		s.leaseMu.Unlock()
+		return
+	}
+	delete(s.leases, name)
+	s.leaseMu.Unlock()
+	j := a.job
+	if j.ctx.Err() != nil {
+		s.finish(j, nil, grpc.Errorf(codes.Canceled, "operation %s was cancelled", name))
+		return
+	}
+	logrus.Warnf("[LEASE] %s expired on %s, queueing it again", name, a.worker)
+	j.op.setStage(pb.ExecuteOperationMetadata_QUEUED)
+	s.jobQueue().pushFront(j)
+}
+
+func (s *ExecutionSrv) leaseDuration() time.Duration {
+	if s.LeaseDuration > 0 {
+		return s.LeaseDuration
+	}
+	return DefaultLeaseDuration
+}
+
+// leaseProto describes j to the worker running it. The action carries the
+// timeout the server allows it, so that workers need not know the limits.
+func (s *ExecutionSrv) leaseProto(j *job) (*lease.Lease, error) {
+	timeout, err := s.timeout(j.in.Action)
+	if err != nil {
+		return nil, err
+	}
+	action := *j.in.Action
+	action.Timeout = nil
+	if timeout > 0 {
+		action.Timeout = ptypes.DurationProto(timeout)
+	}
+	in := *j.in
+	in.Action = &action
+	return &lease.Lease{
+		Name:             j.op.Name,
+		Request:          &in,
+		ActionDigest:     j.op.ActionDigest,
+		WorkingDirectory: j.opts.WorkingDirectory,
+		Duration:         ptypes.DurationProto(s.leaseDuration()),
+		Cancelled:        j.ctx.Err() != nil,
+	}, nil
+}
@@ -0,0 +1,94 @@
+package execution
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/r2d4/bazel-remote-execution-go/server/lease"
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestLeaseExpiry(t *testing.T) {
+	const leaseDuration = 50 * time.Millisecond
+	for _, c := range []struct {
+		desc string
+		// renew keeps the first worker renewing its lease.
+		renew bool
+		// cancel cancels the operation while it is leased.
+		cancel bool
+		// wantRequeued is whether a second worker gets the action.
+		wantRequeued bool
+		wantCode     codes.Code
+	}{
+		{desc: "expired", wantRequeued: true, wantCode: codes.NotFound},
+		{desc: "renewed", renew: true},
+		{desc: "cancelled", cancel: true, wantCode: codes.NotFound},
+	} {
+		s := newTestServer()
+		s.LeaseDuration = leaseDuration
+		ctx := context.Background()
+		op, err := s.Start(ctx, &pb.ExecuteRequest{Action: testAction(t, s, "true")}, ActionOptions{})
+		if err != nil {
+			t.Fatalf("%s: Start() = %v", c.desc, err)
+		}
+		l, err := s.Lease(ctx, &lease.LeaseRequest{Worker: "first"})
+		if err != nil || l.Name != op.Name {
+			t.Fatalf("%s: Lease() = %v, %v, want a lease on %s", c.desc, l, err, op.Name)
+		}
+		if c.cancel {
+			op.Cancel()
+		}
+		for deadline := time.Now().Add(4 * leaseDuration); time.Now().Before(deadline); time.Sleep(leaseDuration / 5) {
+			if !c.renew {
+				continue
+			}
+			if _, err := s.Renew(ctx, &lease.RenewRequest{Name: l.Name, Worker: "first"}); err != nil {
+				t.Fatalf("%s: Renew() = %v", c.desc, err)
+			}
+		}
+
+		pctx, cancel := context.WithTimeout(ctx, leaseDuration/5)
+		second, err := s.Lease(pctx, &lease.LeaseRequest{Worker: "second"})
+		cancel()
+		if requeued := err == nil && second.Name == op.Name; requeued != c.wantRequeued {
+			t.Errorf("%s: second Lease() = %v, %v, want requeued %t", c.desc, second, err, c.wantRequeued)
+		}
+
+		_, err = s.Complete(ctx, &lease.CompleteRequest{Name: l.Name, Worker: "first", Result: &pb.ActionResult{}})
+		if got := grpc.Code(err); got != c.wantCode {
+			t.Errorf("%s: Complete() = %v, want code %s", c.desc, err, c.wantCode)
+		}
+		if c.cancel {
+			if res := op.Response(); codes.Code(res.Status.GetCode()) != codes.Canceled {
+				t.Errorf("%s: response %v, want code Canceled", c.desc, res)
+			}
+		}
+	}
+}
+
+func TestCompleteRequiresResult(t *testing.T) {
+	s := newTestServer()
+	ctx := context.Background()
+	op, err := s.Start(ctx, &pb.ExecuteRequest{Action: testAction(t, s, "true")}, ActionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := s.Lease(ctx, &lease.LeaseRequest{Worker: "w"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Complete(ctx, &lease.CompleteRequest{Name: l.Name, Worker: "w"}); grpc.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Complete() without a result = %v, want InvalidArgument", err)
+	}
+	// The lease survives the bad request.
+	if _, err := s.Complete(ctx, &lease.CompleteRequest{Name: l.Name, Worker: "w", Result: &pb.ActionResult{}}); err != nil {
+		t.Fatalf("Complete() = %v", err)
+	}
+	if res := op.Response(); res.Status != nil || res.Result == nil {
+		t.Fatalf("response %v, want a result", res)
+	}
+}
@@ -0,0 +1,102 @@
+package execution
+
+import (
+	"expvar"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/r2d4/bazel-remote-execution-go/server/cgroup"
+
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Platform properties that lower the server's ActionLimits for a single
+// action.
+const (
+	// memoryLimitProperty is a size in bytes, such as 4G.
+	memoryLimitProperty = "memory-limit"
+	// cpuLimitProperty is a number of CPUs, such as 0.5.
+	cpuLimitProperty  = "cpu-limit"
+	pidsLimitProperty = "pids-limit"
+)
+
+var (
+	actionCPUSeconds = expvar.NewFloat("action_cpu_seconds")
+	actionOOMKills   = expvar.NewInt("action_oom_kills")
+)
+
+// limits returns the resource limits of a, which are the server's unless
+// its platform sets lower ones. Where the server sets a limit, asking for
+// more or for none at all (0) is an error.
+func (s *ExecutionSrv) limits(a *pb.Action) (cgroup.Limits, error) {
+	l := s.ActionLimits
+	if v := platformProperty(a.Platform, memoryLimitProperty); v != "" {
+		n, err := cgroup.ParseBytes(v)
+		if err != nil {
+			return l, grpc.Errorf(codes.InvalidArgument, "invalid %s %q", memoryLimitProperty, v)
+		}
+		if l.MemoryBytes > 0 && (n == 0 || n > l.MemoryBytes) {
+			return l, grpc.Errorf(codes.InvalidArgument, "%s %s is not within the limit of %d bytes", memoryLimitProperty, v, l.MemoryBytes)
+		}
+		l.MemoryBytes = n
+	}
+	if v := platformProperty(a.Platform, cpuLimitProperty); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n < 0 {
+			return l, grpc.Errorf(codes.InvalidArgument, "invalid %s %q", cpuLimitProperty, v)
+		}
+		if l.CPUs > 0 && (n == 0 || n > l.CPUs) {
+			return l, grpc.Errorf(codes.InvalidArgument, "%s %s is not within the limit of %g", cpuLimitProperty, v, l.CPUs)
+		}
+		l.CPUs = n
+	}
+	if v := platformProperty(a.Platform, pidsLimitProperty); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return l, grpc.Errorf(codes.InvalidArgument, "invalid %s %q", pidsLimitProperty, v)
+		}
+		if l.Pids > 0 && (n == 0 || n > l.Pids) {
+			return l, grpc.Errorf(codes.InvalidArgument, "%s %s is not within the limit of %d", pidsLimitProperty, v, l.Pids)
+		}
+		l.Pids = n
+	}
+	return l, nil
+}
+
+// usage returns the resources used by cmd, which has exited. What the
+// cgroup does not account for is taken from cmd and the processes it
+// waited for.
+func usage(cmd *exec.Cmd, group *cgroup.Group) cgroup.Usage {
+	var u cgroup.Usage
+	if group != nil {
+		var err error
+		if u, err = group.Usage(); err != nil {
+			logrus.Warnf("Reading the resource usage of process %d: %s", cmd.Process.Pid, err)
+		}
+	}
+	if cmd.ProcessState == nil {
+		return u
+	}
+	if u.CPUTime == 0 {
+		u.CPUTime = cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
+	}
+	if ru, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage); ok && u.PeakMemoryBytes == 0 {
+		// Linux reports the maximum resident set size in kilobytes.
+		u.PeakMemoryBytes = int64(ru.Maxrss) << 10
+	}
+	return u
+}
+
+// recordUsage logs and exports the resources used by an action.
+func recordUsage(a *pb.Digest, u cgroup.Usage) {
+	actionCPUSeconds.Add(u.CPUTime.Seconds())
+	if u.OOMKilled {
+		actionOOMKills.Add(1)
+	}
+	logrus.Infof("[EXEC] %s used %s of CPU time and at most %d bytes of memory", a.GetHash(), u.CPUTime.Round(time.Millisecond), u.PeakMemoryBytes)
+}
@@ -0,0 +1,199 @@
+package execution
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/r2d4/bazel-remote-execution-go/server/uuid"
+
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Operation is one execution of an action. Callers asking for an action
+// that is already running get an operation of their own that follows the
+// one running it, so each of them can cancel independently.
+type Operation struct {
+	Name         string
+	ActionDigest *pb.Digest
+
+	done   chan struct{}
+	cancel context.CancelFunc
+	// run is the operation this one follows, if any.
+	run *Operation
+
+	mu        sync.Mutex
+	stage     pb.ExecuteOperationMetadata_Stage
+	changed   chan struct{}
+	finished  time.Time
+	response  *pb.ExecuteResponse
+	cancelled bool
+	// waiters counts the callers of this operation and of those following
+	// it that have not cancelled.
+	waiters int
+}
+
+func newOperation(d *pb.Digest) *Operation {
+	return &Operation{
+		Name:         NewOperationName(d),
+		ActionDigest: d,
+		done:         make(chan struct{}),
+		cancel:       func() {},
+		stage:        pb.ExecuteOperationMetadata_QUEUED,
+		changed:      make(chan struct{}),
+		waiters:      1,
+	}
+}
+
+// Done is closed once the operation has finished.
+func (o *Operation) Done() <-chan struct{} {
+	return o.done
+}
+
+// Response returns the response of a finished operation.
+func (o *Operation) Response() *pb.ExecuteResponse {
+	<-o.done
+	return o.response
+}
+
+// Stage returns how far the operation has got.
+func (o *Operation) Stage() pb.ExecuteOperationMetadata_Stage {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.stage
+}
+
+// Changed returns a channel that is closed once the operation is past
+// stage.
+func (o *Operation) Changed(stage pb.ExecuteOperationMetadata_Stage) <-chan struct{} {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.stage != stage {
+		c := make(chan struct{})
+		close(c)
+		return c
+	}
+	return o.changed
+}
+
+// Cancel stops the operation if it is still queued or running and nobody
+// else is waiting for the same run of the action. It then finishes with
+// code Canceled. An operation following another one finishes with code
+// Canceled right away.
+func (o *Operation) Cancel() {
+	o.mu.Lock()
+	cancelled := o.cancelled
+	o.cancelled = true
+	o.mu.Unlock()
+	if cancelled {
+		return
+	}
+	if o.run == nil {
+		o.release()
+		return
+	}
+	o.finish(&pb.ExecuteResponse{
+		Status: statusFor(grpc.Errorf(codes.Canceled, "operation %s was cancelled", o.Name)),
+	})
+	o.run.release()
+}
+
+// join adds a waiter to o, unless it has finished or every waiter has
+// cancelled it.
+func (o *Operation) join() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.waiters == 0 || o.stage == pb.ExecuteOperationMetadata_COMPLETED {
+		return false
+	}
+	o.waiters++
+	return true
+}
+
+// release removes a waiter from o, stopping it once none are left.
+func (o *Operation) release() {
+	o.mu.Lock()
+	o.waiters--
+	left := o.waiters
+	o.mu.Unlock()
+	if left == 0 {
+		o.cancel()
+	}
+}
+
+// follow makes o mirror the stages and the response of run, which the
+// caller has joined.
+func (o *Operation) follow(run *Operation) {
+	o.run = run
+	go func() {
+		for stage := run.Stage(); stage != pb.ExecuteOperationMetadata_COMPLETED; stage = run.Stage() {
+			o.setStage(stage)
+			select {
+			case <-run.Changed(stage):
+			case <-o.done:
+				return
+			}
+		}
+		o.finish(run.Response())
+	}()
+}
+
+func (o *Operation) setStage(stage pb.ExecuteOperationMetadata_Stage) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.stage == stage || o.stage == pb.ExecuteOperationMetadata_COMPLETED {
+		return
+	}
+	o.stage = stage
+	close(o.changed)
+	o.changed = make(chan struct{})
+}
+
+// finish completes the operation with resp, unless it has already
+// finished.
+func (o *Operation) finish(resp *pb.ExecuteResponse) {
+	o.mu.Lock()
+	if o.stage == pb.ExecuteOperationMetadata_COMPLETED {
+		o.mu.Unlock()
+		return
+	}
+	o.stage = pb.ExecuteOperationMetadata_COMPLETED
+	close(o.changed)
+	o.finished = time.Now()
+	o.response = resp
+	o.mu.Unlock()
+	close(o.done)
+}
+
+// finishedBefore reports whether the operation finished before t.
+func (o *Operation) finishedBefore(t time.Time) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return !o.finished.IsZero() && o.finished.Before(t)
+}
+
+// NewOperationName returns a unique name for an execution of the action
+// with digest d. The digest can be recovered with OperationActionDigest.
+func NewOperationName(d *pb.Digest) string {
+	return fmt.Sprintf("operations/%s/%d/%s", d.Hash, d.SizeBytes, uuid.New())
+}
+
+// OperationActionDigest returns the digest of the action that the
+// operation called name executes.
+func OperationActionDigest(name string) (*pb.Digest, error) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 4 || parts[0] != "operations" {
+		return nil, fmt.Errorf("invalid operation name %q", name)
+	}
+	size, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid operation name %q", name)
+	}
+	return &pb.Digest{Hash: parts[1], SizeBytes: size}, nil
+}
@@ -0,0 +1,213 @@
+package execution
+
+import (
+	"encoding/base64"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/empty"
+
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/genproto/googleapis/longrunning"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// DefaultOperationsPageSize is the number of operations ListOperations
+	// returns if the request does not set a page size.
+	DefaultOperationsPageSize = 100
+	// MaxOperationsPageSize is the largest page ListOperations returns.
+	MaxOperationsPageSize = 1000
+)
+
+// GetOperation implements Operations.GetOperation
+func (s *ExecutionSrv) GetOperation(ctx context.Context, in *longrunning.GetOperationRequest) (*longrunning.Operation, error) {
+	logrus.Infof("[Operations] [GET] %s", in.Name)
+	op, ok := s.Operation(in.Name)
+	if !ok {
+		return nil, grpc.Errorf(codes.NotFound, "operation %s not found", in.Name)
+	}
+	return operationProto(op)
+}
+
+// ListOperations implements Operations.ListOperations
+//
+// The filter is a space separated list of terms that operations must all
+// match, each one of done=true, done=false or stage=<ExecuteOperationMetadata
+// stage name>, e.g. "done=false stage=EXECUTING". Request names other than ""
+// and "operations" list the operations whose names start with them, such as
+// operations/<hash>/<size> for the executions of one action.
+func (s *ExecutionSrv) ListOperations(ctx context.Context, in *longrunning.ListOperationsRequest) (*longrunning.ListOperationsResponse, error) {
+	logrus.Infof("[Operations] [LIST] %+v", in)
+	match, err := parseOperationFilter(in.Filter)
+	if err != nil {
+		return nil, err
+	}
+	after, err := parseOperationsPageToken(in.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	size := int(in.PageSize)
+	if size <= 0 {
+		size = DefaultOperationsPageSize
+	}
+	if size > MaxOperationsPageSize {
+		size = MaxOperationsPageSize
+	}
+	prefix := ""
+	if in.Name != "" && in.Name != "operations" {
+		prefix = strings.TrimSuffix(in.Name, "/") + "/"
+	}
+
+	var ops []*Operation
+	s.operations.Range(func(k, v interface{}) bool {
+		op := v.(*Operation)
+		if op.Name > after && strings.HasPrefix(op.Name, prefix) && !s.expired(op) && match(op) {
+			ops = append(ops, op)
+		}
+		return true
+	})
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Name < ops[j].Name })
+
+	resp := &longrunning.ListOperationsResponse{}
+	if len(ops) > size {
+		ops = ops[:size]
+		resp.NextPageToken = operationsPageToken(ops[size-1].Name)
+	}
+	for _, op := range ops {
+		lop, err := operationProto(op)
+		if err != nil {
+			return nil, err
+		}
+		resp.Operations = append(resp.Operations, lop)
+	}
+	return resp, nil
+}
+
+// CancelOperation implements Operations.CancelOperation
+//
+// The command of a cancelled operation is killed, and the operation
+// finishes with code Canceled, once no other caller waits for the same run
+// of the action. Operations following another one finish with code
+// Canceled right away. Operations that already finished are left as they
+// are.
+func (s *ExecutionSrv) CancelOperation(ctx context.Context, in *longrunning.CancelOperationRequest) (*empty.Empty, error) {
+	logrus.Infof("[Operations] [CANCEL] %s", in.Name)
+	op, ok := s.Operation(in.Name)
+	if !ok {
+		return nil, grpc.Errorf(codes.NotFound, "operation %s not found", in.Name)
+	}
+	op.Cancel()
+	return &empty.Empty{}, nil
+}
+
+// DeleteOperation implements Operations.DeleteOperation
+//
+// Only finished operations can be deleted; running ones have to be
+// cancelled first.
+func (s *ExecutionSrv) DeleteOperation(ctx context.Context, in *longrunning.DeleteOperationRequest) (*empty.Empty, error) {
+	logrus.Infof("[Operations] [DELETE] %s", in.Name)
+	op, ok := s.Operation(in.Name)
+	if !ok {
+		return nil, grpc.Errorf(codes.NotFound, "operation %s not found", in.Name)
+	}
+	select {
+	case <-op.Done():
+	default:
+		return nil, grpc.Errorf(codes.FailedPrecondition, "operation %s is still running", in.Name)
+	}
+	s.operations.Delete(in.Name)
+	return &empty.Empty{}, nil
+}
+
+// WaitOperation implements Operations.WaitOperation
+func (s *ExecutionSrv) WaitOperation(ctx context.Context, in *longrunning.WaitOperationRequest) (*longrunning.Operation, error) {
+	logrus.Infof("[Operations] [WAIT] %s", in.Name)
+	op, ok := s.Operation(in.Name)
+	if !ok {
+		return nil, grpc.Errorf(codes.NotFound, "operation %s not found", in.Name)
+	}
+	var expired <-chan time.Time
+	if in.Timeout != nil {
+		timeout, err := ptypes.Duration(in.Timeout)
+		if err != nil {
+			return nil, grpc.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-op.Done():
+	case <-expired:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return operationProto(op)
+}
+
+// parseOperationFilter returns a function reporting whether an operation
+// matches filter.
+func parseOperationFilter(filter string) (func(*Operation) bool, error) {
+	var terms []func(*Operation) bool
+	for _, term := range strings.Fields(filter) {
+		if term == "AND" {
+			continue
+		}
+		kv := strings.SplitN(term, "=", 2)
+		if len(kv) != 2 {
+			return nil, grpc.Errorf(codes.InvalidArgument, "invalid filter term %q", term)
+		}
+		switch kv[0] {
+		case "done":
+			if kv[1] != "true" && kv[1] != "false" {
+				return nil, grpc.Errorf(codes.InvalidArgument, "invalid filter term %q", term)
+			}
+			done := kv[1] == "true"
+			terms = append(terms, func(op *Operation) bool {
+				return (op.Stage() == pb.ExecuteOperationMetadata_COMPLETED) == done
+			})
+		case "stage":
+			v, ok := pb.ExecuteOperationMetadata_Stage_value[kv[1]]
+			if !ok {
+				return nil, grpc.Errorf(codes.InvalidArgument, "unknown stage %q", kv[1])
+			}
+			stage := pb.ExecuteOperationMetadata_Stage(v)
+			terms = append(terms, func(op *Operation) bool {
+				return op.Stage() == stage
+			})
+		default:
+			return nil, grpc.Errorf(codes.InvalidArgument, "cannot filter on %q", kv[0])
+		}
+	}
+	return func(op *Operation) bool {
+		for _, t := range terms {
+			if !t(op) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// operationsPageToken returns the token of the page after the operation
+// called last.
+func operationsPageToken(last string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(last))
+}
+
+// parseOperationsPageToken returns the name of the last operation before
+// the page of token.
+func parseOperationsPageToken(token string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", grpc.Errorf(codes.InvalidArgument, "invalid page token %q", token)
+	}
+	return string(b), nil
+}
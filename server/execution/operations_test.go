@@ -0,0 +1,168 @@
+package execution
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/genproto/googleapis/longrunning"
+	watcher "google.golang.org/genproto/googleapis/watcher/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestListOperationsFilter(t *testing.T) {
+	s := newTestServer()
+	s.OperationRetention = time.Hour
+	newOp := func(hash string, stage pb.ExecuteOperationMetadata_Stage) string {
+		op := newOperation(&pb.Digest{Hash: hash, SizeBytes: 1})
+		if stage == pb.ExecuteOperationMetadata_COMPLETED {
+			op.finish(&pb.ExecuteResponse{})
+		} else {
+			op.setStage(stage)
+		}
+		s.operations.Store(op.Name, op)
+		return op.Name
+	}
+	queued := newOp("aa", pb.ExecuteOperationMetadata_QUEUED)
+	executing := newOp("aa", pb.ExecuteOperationMetadata_EXECUTING)
+	completed := newOp("bb", pb.ExecuteOperationMetadata_COMPLETED)
+	// Operations past their retention are not listed.
+	expired := newOperation(&pb.Digest{Hash: "bb", SizeBytes: 1})
+	expired.finish(&pb.ExecuteResponse{})
+	expired.finished = time.Now().Add(-2 * time.Hour)
+	s.operations.Store(expired.Name, expired)
+
+	for _, c := range []struct {
+		name     string
+		filter   string
+		want     []string
+		wantCode codes.Code
+	}{
+		{filter: "", want: []string{queued, executing, completed}},
+		{name: "operations", want: []string{queued, executing, completed}},
+		{filter: "done=true", want: []string{completed}},
+		{filter: "done=false", want: []string{queued, executing}},
+		{filter: "stage=EXECUTING", want: []string{executing}},
+		{filter: "done=false AND stage=QUEUED", want: []string{queued}},
+		{filter: "done=true stage=QUEUED"},
+		{name: "operations/aa/1", filter: "done=false", want: []string{queued, executing}},
+		{name: "operations/bb/1/", want: []string{completed}},
+		{name: "operations/cc"},
+		{filter: "done=maybe", wantCode: codes.InvalidArgument},
+		{filter: "done", wantCode: codes.InvalidArgument},
+		{filter: "stage=RUNNING", wantCode: codes.InvalidArgument},
+		{filter: "worker=w1", wantCode: codes.InvalidArgument},
+	} {
+		res, err := s.ListOperations(context.Background(), &longrunning.ListOperationsRequest{
+			Name:   c.name,
+			Filter: c.filter,
+		})
+		if got := grpc.Code(err); got != c.wantCode {
+			t.Errorf("ListOperations(%q, %q) = %v, want code %s", c.name, c.filter, err, c.wantCode)
+			continue
+		}
+		got := map[string]bool{}
+		for _, op := range res.GetOperations() {
+			got[op.Name] = true
+		}
+		if len(got) != len(c.want) {
+			t.Errorf("ListOperations(%q, %q) = %d operations, want %d", c.name, c.filter, len(got), len(c.want))
+			continue
+		}
+		for _, name := range c.want {
+			if !got[name] {
+				t.Errorf("ListOperations(%q, %q) is missing %s", c.name, c.filter, name)
+			}
+		}
+	}
+}
+
+func TestCancelSharedOperation(t *testing.T) {
+	s := newTestServer()
+	ctx := context.Background()
+	in := &pb.ExecuteRequest{Action: testAction(t, s, "true")}
+	var ops []*Operation
+	for i := 0; i < 3; i++ {
+		op, err := s.Start(ctx, in, ActionOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ops = append(ops, op)
+	}
+	if ops[0].Name == ops[1].Name || ops[1].Name == ops[2].Name {
+		t.Fatalf("operations %s, %s and %s share a name", ops[0].Name, ops[1].Name, ops[2].Name)
+	}
+	running := func() bool {
+		select {
+		case <-ops[0].Done():
+			return false
+		default:
+			return true
+		}
+	}
+
+	for _, c := range []struct {
+		cancel      int
+		wantRunning bool
+	}{
+		{cancel: 1, wantRunning: true},
+		{cancel: 1, wantRunning: true},
+		{cancel: 0, wantRunning: true},
+		{cancel: 2, wantRunning: false},
+	} {
+		if _, err := s.CancelOperation(ctx, &longrunning.CancelOperationRequest{Name: ops[c.cancel].Name}); err != nil {
+			t.Fatal(err)
+		}
+		if c.cancel != 0 {
+			if res := ops[c.cancel].Response(); codes.Code(res.Status.GetCode()) != codes.Canceled {
+				t.Errorf("after cancelling operation %d: response %v, want code Canceled", c.cancel, res)
+			}
+		}
+		if got := running(); got != c.wantRunning {
+			t.Errorf("after cancelling operation %d: running = %t, want %t", c.cancel, got, c.wantRunning)
+		}
+	}
+	if res := ops[0].Response(); codes.Code(res.Status.GetCode()) != codes.Canceled {
+		t.Errorf("response %v, want code Canceled", res)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	for _, c := range []struct {
+		desc      string
+		buffer    int
+		wantEvent bool
+	}{
+		{desc: "nobody watching"},
+		{desc: "watched", buffer: 1, wantEvent: true},
+	} {
+		s := newTestServer()
+		s.CASChan = make(chan watcher.Change, c.buffer)
+		op := newOperation(&pb.Digest{Hash: "aa", SizeBytes: 1})
+		op.finish(&pb.ExecuteResponse{})
+
+		done := make(chan struct{})
+		go func() {
+			s.publish(op)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: publish() blocked", c.desc)
+		}
+		select {
+		case change := <-s.CASChan:
+			if !c.wantEvent || change.Element != op.Name {
+				t.Errorf("%s: got change for %s", c.desc, change.Element)
+			}
+		default:
+			if c.wantEvent {
+				t.Errorf("%s: no change published", c.desc)
+			}
+		}
+	}
+}
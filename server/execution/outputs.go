@@ -0,0 +1,210 @@
+package execution
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// collectOutputs uploads the outputs of in.Action found under dir to the
+// CAS and adds them to res. Outputs the command did not create are left out.
+// v1test cannot represent symlinks, so they are uploaded as what they point
+// to, as long as that is inside root.
+func (s *ExecutionSrv) collectOutputs(in *pb.ExecuteRequest, root, dir string, res *pb.ActionResult) error {
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return internalError(err, "resolving exec root")
+	}
+	for _, path := range in.Action.OutputFiles {
+		p, err := execPath(dir, path)
+		if err != nil {
+			return err
+		}
+		p, err = resolveOutput(root, p)
+		if os.IsNotExist(err) {
+			logrus.Infof("Output file %s was not created", path)
+			continue
+		}
+		if err != nil {
+			return internalError(err, "output file %s", path)
+		}
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			logrus.Infof("Output file %s was not created", path)
+			continue
+		}
+		if err != nil {
+			return internalError(err, "output file %s", path)
+		}
+		if fi.IsDir() {
+			return grpc.Errorf(codes.FailedPrecondition, "output file %s is a directory", path)
+		}
+		o := &pb.OutputFile{
+			Path:         path,
+			IsExecutable: fi.Mode()&0111 != 0,
+		}
+		if o.Digest, err = s.uploadFile(p); err != nil {
+			return internalError(err, "uploading output file %s", path)
+		}
+		if fi.Size() <= maxInlineOutputBytes {
+			if o.Content, err = ioutil.ReadFile(p); err != nil {
+				return internalError(err, "reading output file %s", path)
+			}
+		}
+		res.OutputFiles = append(res.OutputFiles, o)
+	}
+
+	for _, path := range in.Action.OutputDirectories {
+		p, err := execPath(dir, path)
+		if err != nil {
+			return err
+		}
+		p, err = resolveOutput(root, p)
+		if os.IsNotExist(err) {
+			logrus.Infof("Output directory %s was not created", path)
+			continue
+		}
+		if err != nil {
+			return internalError(err, "output directory %s", path)
+		}
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			logrus.Infof("Output directory %s was not created", path)
+			continue
+		}
+		if err != nil {
+			return internalError(err, "output directory %s", path)
+		}
+		if !fi.IsDir() {
+			return grpc.Errorf(codes.FailedPrecondition, "output directory %s is not a directory", path)
+		}
+		tree := &pb.Tree{}
+		seen := map[string]bool{}
+		parents := map[string]bool{p: true}
+		if tree.Root, err = s.uploadDirectory(root, p, tree, seen, parents); err != nil {
+			return internalError(err, "uploading output directory %s", path)
+		}
+		d, err := s.uploadMessage(tree)
+		if err != nil {
+			return internalError(err, "uploading tree of %s", path)
+		}
+		res.OutputDirectories = append(res.OutputDirectories, &pb.OutputDirectory{
+			Path:       path,
+			TreeDigest: d,
+		})
+	}
+	return nil
+}
+
+// uploadDirectory uploads the files under path and returns the Directory
+// describing it. Every directory below path is added to tree.Children once.
+// Symlinks are followed if they stay inside root, and parents holds the
+// directories being uploaded to catch symlinks that loop back to them.
+func (s *ExecutionSrv) uploadDirectory(root, path string, tree *pb.Tree, seen, parents map[string]bool) (*pb.Directory, error) {
+	// ReadDir sorts by name, as the Directory message requires.
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	dir := &pb.Directory{}
+	for _, e := range entries {
+		p := filepath.Join(path, e.Name())
+		fi := e
+		if e.Mode()&os.ModeSymlink != 0 {
+			if p, err = resolveOutput(root, p); err != nil {
+				return nil, err
+			}
+			if parents[p] {
+				return nil, grpc.Errorf(codes.FailedPrecondition, "symlink %s loops back to %s", filepath.Join(path, e.Name()), p)
+			}
+			if fi, err = os.Lstat(p); err != nil {
+				return nil, err
+			}
+		}
+		if !fi.Mode().IsDir() && !fi.Mode().IsRegular() {
+			return nil, grpc.Errorf(codes.FailedPrecondition, "%s is neither a file nor a directory", p)
+		}
+		if !fi.IsDir() {
+			d, err := s.uploadFile(p)
+			if err != nil {
+				return nil, err
+			}
+			dir.Files = append(dir.Files, &pb.FileNode{
+				Name:         e.Name(),
+				Digest:       d,
+				IsExecutable: fi.Mode()&0111 != 0,
+			})
+			continue
+		}
+		parents[p] = true
+		child, err := s.uploadDirectory(root, p, tree, seen, parents)
+		delete(parents, p)
+		if err != nil {
+			return nil, err
+		}
+		b, err := proto.Marshal(child)
+		if err != nil {
+			return nil, err
+		}
+		d := s.DigestFunction.FromBytes(b)
+		if !seen[d.Hash] {
+			seen[d.Hash] = true
+			tree.Children = append(tree.Children, child)
+		}
+		dir.Directories = append(dir.Directories, &pb.DirectoryNode{
+			Name:   e.Name(),
+			Digest: d,
+		})
+	}
+	return dir, nil
+}
+
+// resolveOutput follows the symlinks in the output path p and returns the
+// path it refers to, refusing any that lead outside root.
+func resolveOutput(root, p string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", grpc.Errorf(codes.FailedPrecondition, "%s points to %s, outside the exec root", p, resolved)
+	}
+	return resolved, nil
+}
+
+func (s *ExecutionSrv) uploadFile(path string) (*pb.Digest, error) {
+	d, err := s.DigestFunction.FromFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := s.Cache.Put(d, f); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (s *ExecutionSrv) uploadMessage(m proto.Message) (*pb.Digest, error) {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	d := s.DigestFunction.FromBytes(b)
+	if err := s.Cache.Put(d, bytes.NewReader(b)); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
@@ -0,0 +1,230 @@
+package execution
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+)
+
+// MatchRule says how a platform property an action asks for is compared
+// with the properties of workers.
+type MatchRule int
+
+const (
+	// MatchExact requires a worker property with the same value.
+	MatchExact MatchRule = iota
+	// MatchPrefix requires a worker property whose value starts with the
+	// value asked for, so that actions asking for gpu=nvidia run on
+	// workers with gpu=nvidia-t4.
+	MatchPrefix
+	// MatchIgnore lets any worker run the action, whatever its properties.
+	MatchIgnore
+	// MatchIgnoreCase requires a worker property with the same value,
+	// ignoring case, so that actions asking for OSFamily=Linux run on
+	// workers with OSFamily=linux.
+	MatchIgnoreCase
+)
+
+// defaultMatchRules apply to properties that PlatformRules does not
+// mention. network and resource limits are handled by the executor itself,
+// on every worker. Commands never run in containers, so container-image is
+// ignored, and OSFamily and Arch are matched without regard to case, as
+// clients spell them differently.
+var defaultMatchRules = map[string]MatchRule{
+	"OSFamily":          MatchIgnoreCase,
+	"Arch":              MatchIgnoreCase,
+	"container-image":   MatchIgnore,
+	"network":           MatchIgnore,
+	memoryLimitProperty: MatchIgnore,
+	cpuLimitProperty:    MatchIgnore,
+	pidsLimitProperty:   MatchIgnore,
+}
+
+// ParseMatchRules parses a comma separated list of rules such as
+// "pool=exact,gpu=prefix,OSFamily=ignorecase".
+func ParseMatchRules(s string) (map[string]MatchRule, error) {
+	rules := map[string]MatchRule{}
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid platform rule %q", e)
+		}
+		switch kv[1] {
+		case "exact":
+			rules[kv[0]] = MatchExact
+		case "prefix":
+			rules[kv[0]] = MatchPrefix
+		case "ignore":
+			rules[kv[0]] = MatchIgnore
+		case "ignorecase":
+			rules[kv[0]] = MatchIgnoreCase
+		default:
+			return nil, fmt.Errorf("unknown platform rule %q for %s, want exact, prefix, ignore or ignorecase", kv[1], kv[0])
+		}
+	}
+	return rules, nil
+}
+
+// HostPlatform returns the platform of this machine: the properties
+// OSFamily and Arch, set to Go's names for them and for amd64 and arm64
+// also to the x86_64 and aarch64 that Bazel uses, and the properties in s,
+// a comma separated list such as "pool=large,OSFamily=Linux". Properties
+// in s replace those of the same name, and may be given more than once to
+// advertise several values.
+func HostPlatform(s string) (*pb.Platform, error) {
+	given := &pb.Platform{}
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid platform property %q", e)
+		}
+		given.Properties = append(given.Properties, &pb.Platform_Property{Name: kv[0], Value: kv[1]})
+	}
+	p := &pb.Platform{}
+	host := []*pb.Platform_Property{
+		{Name: "OSFamily", Value: runtime.GOOS},
+		{Name: "Arch", Value: runtime.GOARCH},
+	}
+	if arch, ok := archAliases[runtime.GOARCH]; ok {
+		host = append(host, &pb.Platform_Property{Name: "Arch", Value: arch})
+	}
+	for _, prop := range host {
+		if platformProperty(given, prop.Name) == "" {
+			p.Properties = append(p.Properties, prop)
+		}
+	}
+	p.Properties = append(p.Properties, given.Properties...)
+	return p, nil
+}
+
+// archAliases are other names of Go's architectures that actions use.
+var archAliases = map[string]string{
+	"amd64": "x86_64",
+	"arm64": "aarch64",
+}
+
+// platformProperty returns the value of the named platform property, or ""
+// if it is not set.
+func platformProperty(p *pb.Platform, name string) string {
+	for _, prop := range p.GetProperties() {
+		if prop.Name == name {
+			return prop.Value
+		}
+	}
+	return ""
+}
+
+// matchRule returns how the property called name is matched.
+func (s *ExecutionSrv) matchRule(name string) MatchRule {
+	if rule, ok := s.PlatformRules[name]; ok {
+		return rule
+	}
+	return defaultMatchRules[name]
+}
+
+// satisfies reports whether a worker with the properties of worker can run
+// actions that ask for want.
+func (s *ExecutionSrv) satisfies(worker, want *pb.Platform) bool {
+	for _, p := range want.GetProperties() {
+		rule := s.matchRule(p.Name)
+		if rule == MatchIgnore {
+			continue
+		}
+		found := false
+		for _, w := range worker.GetProperties() {
+			if w.Name != p.Name {
+				continue
+			}
+			if w.Value == p.Value ||
+				rule == MatchPrefix && strings.HasPrefix(w.Value, p.Value) ||
+				rule == MatchIgnoreCase && strings.EqualFold(w.Value, p.Value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// workerInfo is what the server knows about a worker that leases actions.
+type workerInfo struct {
+	platform *pb.Platform
+	// polling counts the worker's Lease calls that are waiting for an
+	// action.
+	polling  int
+	lastSeen time.Time
+}
+
+// runsLocally reports whether the server's runners can run j.
+func (s *ExecutionSrv) runsLocally(j *job) bool {
+	return s.Platform == nil || s.satisfies(s.Platform, j.in.Action.GetPlatform())
+}
+
+// canRun reports whether a runner or a registered worker satisfies want.
+// Workers stay registered while they wait for actions and for a lease
+// duration after they were last heard from. While no worker is registered,
+// servers without runners queue all actions for the workers to come.
+func (s *ExecutionSrv) canRun(want *pb.Platform) bool {
+	if !s.WorkersOnly && (s.Platform == nil || s.satisfies(s.Platform, want)) {
+		return true
+	}
+	s.leaseMu.Lock()
+	defer s.leaseMu.Unlock()
+	alive := time.Now().Add(-s.leaseDuration())
+	for name, w := range s.workers {
+		if w.polling == 0 && w.lastSeen.Before(alive) {
+			delete(s.workers, name)
+			continue
+		}
+		if s.satisfies(w.platform, want) {
+			return true
+		}
+	}
+	return s.WorkersOnly && len(s.workers) == 0
+}
+
+// startPolling registers the worker called name as waiting for an action.
+// The returned function ends the wait.
+func (s *ExecutionSrv) startPolling(name string, platform *pb.Platform) func() {
+	s.leaseMu.Lock()
+	defer s.leaseMu.Unlock()
+	if s.workers == nil {
+		s.workers = map[string]*workerInfo{}
+	}
+	w, ok := s.workers[name]
+	if !ok {
+		logrus.Infof("[LEASE] Worker %s registered with platform %v", name, platform.GetProperties())
+		w = &workerInfo{}
+		s.workers[name] = w
+	}
+	w.platform = platform
+	w.polling++
+	return func() {
+		s.leaseMu.Lock()
+		defer s.leaseMu.Unlock()
+		w.polling--
+		w.lastSeen = time.Now()
+	}
+}
+
+// sawWorker notes that the worker called name is alive. s.leaseMu must be
+// held.
+func (s *ExecutionSrv) sawWorker(name string) {
+	if w, ok := s.workers[name]; ok {
+		w.lastSeen = time.Now()
+	}
+}
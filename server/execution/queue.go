@@ -0,0 +1,87 @@
+package execution
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+)
+
+// job is an action waiting for, or being run by, a runner or worker.
+type job struct {
+	op   *Operation
+	in   *pb.ExecuteRequest
+	opts ActionOptions
+	// key is where op is registered as in flight, if anywhere.
+	key string
+	ctx context.Context
+}
+
+// queue holds jobs in the order they are to be run.
+type queue struct {
+	mu   sync.Mutex
+	jobs []*job
+	// pushed is closed when a job is added.
+	pushed chan struct{}
+}
+
+func newQueue() *queue {
+	return &queue{pushed: make(chan struct{})}
+}
+
+func (q *queue) push(j *job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.jobs = append(q.jobs, j)
+	q.notify()
+}
+
+// pushFront queues j ahead of all other jobs, for jobs that have waited
+// their turn already.
+func (q *queue) pushFront(j *job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.jobs = append([]*job{j}, q.jobs...)
+	q.notify()
+}
+
+func (q *queue) notify() {
+	close(q.pushed)
+	q.pushed = make(chan struct{})
+}
+
+// pop waits for a job that accept returns true for and takes the first
+// such job off the queue. It fails if ctx is done first.
+func (q *queue) pop(ctx context.Context, accept func(*job) bool) (*job, error) {
+	for {
+		q.mu.Lock()
+		for i, j := range q.jobs {
+			if accept(j) {
+				q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+				q.mu.Unlock()
+				return j, nil
+			}
+		}
+		pushed := q.pushed
+		q.mu.Unlock()
+		select {
+		case <-pushed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// remove takes j off the queue, reporting whether it was still queued.
+func (q *queue) remove(j *job) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, queued := range q.jobs {
+		if queued == j {
+			q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
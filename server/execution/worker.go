@@ -0,0 +1,140 @@
+package execution
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/r2d4/bazel-remote-execution-go/server/lease"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// leasePollTimeout is how long a worker waits for an action to be
+	// queued before asking again.
+	leasePollTimeout = time.Minute
+	// leaseRetryDelay is how long a worker waits after failing to reach
+	// the server.
+	leaseRetryDelay = 5 * time.Second
+)
+
+// Worker runs actions that it leases from a server.
+type Worker struct {
+	// Execution runs the leased actions. Its cache should store blobs in
+	// the CAS of the server, and its Platform is advertised to the server
+	// so that only actions the worker can run are leased to it.
+	Execution *ExecutionSrv
+	Leases    lease.LeasesClient
+	// Name identifies the worker to the server.
+	Name string
+	// Concurrency is how many actions the worker runs at once. It defaults
+	// to the number of CPUs.
+	Concurrency int
+}
+
+// Run leases and runs actions until ctx is done.
+func (w *Worker) Run(ctx context.Context) {
+	n := w.Concurrency
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			w.loop(ctx, name)
+		}(fmt.Sprintf("%s/%d", w.Name, i))
+	}
+	wg.Wait()
+}
+
+// loop runs one action at a time as the worker called name.
+func (w *Worker) loop(ctx context.Context, name string) {
+	for ctx.Err() == nil {
+		pollCtx, cancel := context.WithTimeout(ctx, leasePollTimeout)
+		l, err := w.Leases.Lease(pollCtx, &lease.LeaseRequest{
+			Worker:   name,
+			Platform: w.Execution.Platform,
+		})
+		cancel()
+		if grpc.Code(err) == codes.DeadlineExceeded {
+			continue
+		}
+		if err != nil {
+			logrus.Warnf("[%s] Leasing an action: %s", name, err)
+			select {
+			case <-time.After(leaseRetryDelay):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		w.runLease(ctx, name, l)
+	}
+}
+
+// runLease runs the action of l and reports its result to the server.
+func (w *Worker) runLease(ctx context.Context, name string, l *lease.Lease) {
+	logrus.Infof("[%s] Running %s", name, l.Name)
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go w.renew(runCtx, cancel, name, l)
+
+	res, err := w.Execution.Run(runCtx, l.Request, ActionOptions{
+		ActionDigest:     l.ActionDigest,
+		WorkingDirectory: l.WorkingDirectory,
+	})
+	if err == nil && runCtx.Err() != nil {
+		err = grpc.Errorf(codes.Canceled, "operation %s was cancelled", l.Name)
+	}
+	req := &lease.CompleteRequest{
+		Name:   l.Name,
+		Worker: name,
+		Result: res,
+	}
+	if err != nil {
+		req.Status = statusFor(err)
+	}
+	if _, err := w.Leases.Complete(ctx, req); err != nil {
+		logrus.Warnf("[%s] Completing %s: %s", name, l.Name, err)
+	}
+}
+
+// renew keeps l alive until ctx is done. It calls cancel to stop the
+// action if the operation is cancelled or the lease is lost.
+func (w *Worker) renew(ctx context.Context, cancel context.CancelFunc, name string, l *lease.Lease) {
+	d, err := ptypes.Duration(l.Duration)
+	if err != nil || d <= 0 {
+		d = DefaultLeaseDuration
+	}
+	ticker := time.NewTicker(d / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		renewed, err := w.Leases.Renew(ctx, &lease.RenewRequest{Name: l.Name, Worker: name})
+		if grpc.Code(err) == codes.NotFound {
+			logrus.Warnf("[%s] Lost the lease on %s", name, l.Name)
+			cancel()
+			return
+		}
+		if err != nil {
+			logrus.Warnf("[%s] Renewing the lease on %s: %s", name, l.Name, err)
+			continue
+		}
+		if renewed.Cancelled {
+			cancel()
+			return
+		}
+	}
+}
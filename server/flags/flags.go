@@ -0,0 +1,46 @@
+// Package flags parses the command line flags that the server and the
+// worker share.
+package flags
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/r2d4/bazel-remote-execution-go/server/cgroup"
+)
+
+// SplitList splits a comma separated flag value, dropping empty entries.
+func SplitList(s string) []string {
+	var l []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
+// ActionLimits returns the default resource limits of actions set by the
+// --action_memory_limit, --action_cpu_limit and --action_pids_limit flags,
+// which only take effect with --cgroup_root. It fails if actions cannot be
+// run in groups under --cgroup_root.
+func ActionLimits(cgroupRoot, memory string, cpus float64, pids int64) (cgroup.Limits, error) {
+	l := cgroup.Limits{CPUs: cpus, Pids: pids}
+	if cgroupRoot != "" {
+		if err := cgroup.Check(cgroupRoot); err != nil {
+			return l, fmt.Errorf("--cgroup_root: %v", err)
+		}
+	}
+	if memory != "" {
+		n, err := cgroup.ParseBytes(memory)
+		if err != nil {
+			return l, fmt.Errorf("--action_memory_limit: %v", err)
+		}
+		l.MemoryBytes = n
+	}
+	if cgroupRoot == "" && (l.MemoryBytes > 0 || l.CPUs > 0 || l.Pids > 0) {
+		return l, errors.New("action limits need --cgroup_root")
+	}
+	return l, nil
+}
@@ -0,0 +1,469 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: server/lease/lease.proto
+
+package lease
+
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	duration "github.com/golang/protobuf/ptypes/duration"
+	empty "github.com/golang/protobuf/ptypes/empty"
+	v1test "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	status "google.golang.org/genproto/googleapis/rpc/status"
+	grpc "google.golang.org/grpc"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+type LeaseRequest struct {
+	// Identifies the worker in logs.
+	Worker string `protobuf:"bytes,1,opt,name=worker,proto3" json:"worker,omitempty"`
+	// The properties of the worker. Only actions whose platform they satisfy
+	// are leased to it.
+	Platform             *v1test.Platform `protobuf:"bytes,2,opt,name=platform,proto3" json:"platform,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}         `json:"-"`
+	XXX_unrecognized     []byte           `json:"-"`
+	XXX_sizecache        int32            `json:"-"`
+}
+
+func (m *LeaseRequest) Reset()         { *m = LeaseRequest{} }
+func (m *LeaseRequest) String() string { return proto.CompactTextString(m) }
+func (*LeaseRequest) ProtoMessage()    {}
+func (*LeaseRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_321a1dbc7601879d, []int{0}
+}
+
+func (m *LeaseRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_LeaseRequest.Unmarshal(m, b)
+}
+func (m *LeaseRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_LeaseRequest.Marshal(b, m, deterministic)
+}
+func (m *LeaseRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_LeaseRequest.Merge(m, src)
+}
+func (m *LeaseRequest) XXX_Size() int {
+	return xxx_messageInfo_LeaseRequest.Size(m)
+}
+func (m *LeaseRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_LeaseRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_LeaseRequest proto.InternalMessageInfo
+
+func (m *LeaseRequest) GetWorker() string {
+	if m != nil {
+		return m.Worker
+	}
+	return ""
+}
+
+func (m *LeaseRequest) GetPlatform() *v1test.Platform {
+	if m != nil {
+		return m.Platform
+	}
+	return nil
+}
+
+type Lease struct {
+	// The name of the operation executing the action.
+	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// The action to run. Its timeout is the one the server allows it.
+	Request *v1test.ExecuteRequest `protobuf:"bytes,2,opt,name=request,proto3" json:"request,omitempty"`
+	// The key of the action in the action cache.
+	ActionDigest *v1test.Digest `protobuf:"bytes,3,opt,name=action_digest,json=actionDigest,proto3" json:"action_digest,omitempty"`
+	// The directory, relative to the exec root, that the command runs in.
+	WorkingDirectory string `protobuf:"bytes,4,opt,name=working_directory,json=workingDirectory,proto3" json:"working_directory,omitempty"`
+	// How long the lease lasts unless it is renewed.
+	Duration *duration.Duration `protobuf:"bytes,5,opt,name=duration,proto3" json:"duration,omitempty"`
+	// Set once the operation has been cancelled. The worker should stop
+	// running the action and complete the lease.
+	Cancelled            bool     `protobuf:"varint,6,opt,name=cancelled,proto3" json:"cancelled,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Lease) Reset()         { *m = Lease{} }
+func (m *Lease) String() string { return proto.CompactTextString(m) }
+func (*Lease) ProtoMessage()    {}
+func (*Lease) Descriptor() ([]byte, []int) {
+	return fileDescriptor_321a1dbc7601879d, []int{1}
+}
+
+func (m *Lease) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Lease.Unmarshal(m, b)
+}
+func (m *Lease) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Lease.Marshal(b, m, deterministic)
+}
+func (m *Lease) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Lease.Merge(m, src)
+}
+func (m *Lease) XXX_Size() int {
+	return xxx_messageInfo_Lease.Size(m)
+}
+func (m *Lease) XXX_DiscardUnknown() {
+	xxx_messageInfo_Lease.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Lease proto.InternalMessageInfo
+
+func (m *Lease) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *Lease) GetRequest() *v1test.ExecuteRequest {
+	if m != nil {
+		return m.Request
+	}
+	return nil
+}
+
+func (m *Lease) GetActionDigest() *v1test.Digest {
+	if m != nil {
+		return m.ActionDigest
+	}
+	return nil
+}
+
+func (m *Lease) GetWorkingDirectory() string {
+	if m != nil {
+		return m.WorkingDirectory
+	}
+	return ""
+}
+
+func (m *Lease) GetDuration() *duration.Duration {
+	if m != nil {
+		return m.Duration
+	}
+	return nil
+}
+
+func (m *Lease) GetCancelled() bool {
+	if m != nil {
+		return m.Cancelled
+	}
+	return false
+}
+
+type RenewRequest struct {
+	// The name of the leased operation.
+	Name                 string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Worker               string   `protobuf:"bytes,2,opt,name=worker,proto3" json:"worker,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RenewRequest) Reset()         { *m = RenewRequest{} }
+func (m *RenewRequest) String() string { return proto.CompactTextString(m) }
+func (*RenewRequest) ProtoMessage()    {}
+func (*RenewRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_321a1dbc7601879d, []int{2}
+}
+
+func (m *RenewRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RenewRequest.Unmarshal(m, b)
+}
+func (m *RenewRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RenewRequest.Marshal(b, m, deterministic)
+}
+func (m *RenewRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RenewRequest.Merge(m, src)
+}
+func (m *RenewRequest) XXX_Size() int {
+	return xxx_messageInfo_RenewRequest.Size(m)
+}
+func (m *RenewRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_RenewRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RenewRequest proto.InternalMessageInfo
+
+func (m *RenewRequest) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *RenewRequest) GetWorker() string {
+	if m != nil {
+		return m.Worker
+	}
+	return ""
+}
+
+type CompleteRequest struct {
+	// The name of the leased operation.
+	Name   string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Worker string `protobuf:"bytes,2,opt,name=worker,proto3" json:"worker,omitempty"`
+	// What running the action produced, if anything.
+	Result *v1test.ActionResult `protobuf:"bytes,3,opt,name=result,proto3" json:"result,omitempty"`
+	// Why the action could not be run, if it could not.
+	Status               *status.Status `protobuf:"bytes,4,opt,name=status,proto3" json:"status,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}       `json:"-"`
+	XXX_unrecognized     []byte         `json:"-"`
+	XXX_sizecache        int32          `json:"-"`
+}
+
+func (m *CompleteRequest) Reset()         { *m = CompleteRequest{} }
+func (m *CompleteRequest) String() string { return proto.CompactTextString(m) }
+func (*CompleteRequest) ProtoMessage()    {}
+func (*CompleteRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_321a1dbc7601879d, []int{3}
+}
+
+func (m *CompleteRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CompleteRequest.Unmarshal(m, b)
+}
+func (m *CompleteRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CompleteRequest.Marshal(b, m, deterministic)
+}
+func (m *CompleteRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CompleteRequest.Merge(m, src)
+}
+func (m *CompleteRequest) XXX_Size() int {
+	return xxx_messageInfo_CompleteRequest.Size(m)
+}
+func (m *CompleteRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_CompleteRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CompleteRequest proto.InternalMessageInfo
+
+func (m *CompleteRequest) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *CompleteRequest) GetWorker() string {
+	if m != nil {
+		return m.Worker
+	}
+	return ""
+}
+
+func (m *CompleteRequest) GetResult() *v1test.ActionResult {
+	if m != nil {
+		return m.Result
+	}
+	return nil
+}
+
+func (m *CompleteRequest) GetStatus() *status.Status {
+	if m != nil {
+		return m.Status
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*LeaseRequest)(nil), "remote_executor.lease.LeaseRequest")
+	proto.RegisterType((*Lease)(nil), "remote_executor.lease.Lease")
+	proto.RegisterType((*RenewRequest)(nil), "remote_executor.lease.RenewRequest")
+	proto.RegisterType((*CompleteRequest)(nil), "remote_executor.lease.CompleteRequest")
+}
+
+func init() { proto.RegisterFile("server/lease/lease.proto", fileDescriptor_321a1dbc7601879d) }
+
+var fileDescriptor_321a1dbc7601879d = []byte{
+	// 496 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x54, 0xdd, 0x6e, 0xd3, 0x30,
+	0x14, 0x56, 0xca, 0x16, 0x3a, 0xaf, 0x08, 0xb0, 0x44, 0x09, 0x65, 0x42, 0x55, 0x91, 0x50, 0x05,
+	0xaa, 0x03, 0x65, 0x70, 0x01, 0x08, 0x09, 0xe8, 0x6e, 0x50, 0x2f, 0x26, 0xef, 0x8e, 0x9b, 0x2a,
+	0x3f, 0x67, 0x21, 0xc2, 0x89, 0x83, 0xed, 0x74, 0x8c, 0x17, 0xe3, 0x05, 0x78, 0x1c, 0x1e, 0x02,
+	0xc5, 0x3f, 0x6d, 0x18, 0x2b, 0x54, 0xbb, 0xb1, 0xe2, 0xf3, 0x9d, 0xf3, 0x7d, 0xf6, 0x77, 0x8e,
+	0x83, 0x02, 0x09, 0x62, 0x09, 0x22, 0x64, 0x10, 0x49, 0x30, 0x2b, 0xa9, 0x04, 0x57, 0x1c, 0xdf,
+	0x11, 0x50, 0x70, 0x05, 0x0b, 0xf8, 0x06, 0x49, 0xad, 0xb8, 0x20, 0x1a, 0x1c, 0xf4, 0xff, 0x08,
+	0xe7, 0xbc, 0x34, 0xe9, 0x83, 0x07, 0x19, 0xe7, 0x19, 0x83, 0x50, 0xef, 0xe2, 0xfa, 0x34, 0x4c,
+	0x6b, 0x11, 0xb5, 0xf0, 0xfb, 0x17, 0x71, 0x28, 0x2a, 0x75, 0x6e, 0xc1, 0xbb, 0x16, 0x14, 0x55,
+	0x12, 0x4a, 0x15, 0xa9, 0x5a, 0x1a, 0x60, 0xa4, 0x50, 0x6f, 0xde, 0xc8, 0x52, 0xf8, 0x5a, 0x83,
+	0x54, 0xb8, 0x8f, 0xfc, 0x33, 0x2e, 0xbe, 0x80, 0x08, 0xbc, 0xa1, 0x37, 0xde, 0xa3, 0x76, 0x87,
+	0xe7, 0xa8, 0x5b, 0xb1, 0x48, 0x9d, 0x72, 0x51, 0x04, 0x9d, 0xa1, 0x37, 0xde, 0x9f, 0x3e, 0x25,
+	0x86, 0x93, 0xa4, 0xb0, 0x54, 0x9c, 0x33, 0x49, 0xcc, 0xc1, 0xd7, 0xe7, 0x5e, 0x3e, 0x53, 0x20,
+	0x15, 0x39, 0xb6, 0x75, 0x74, 0xc5, 0x30, 0xfa, 0xd9, 0x41, 0xbb, 0x5a, 0x16, 0x63, 0xb4, 0x53,
+	0x46, 0x05, 0x58, 0x35, 0xfd, 0x8d, 0x8f, 0xd1, 0x75, 0x61, 0x8e, 0x63, 0xa5, 0x5e, 0x6e, 0x2b,
+	0x75, 0xa4, 0x03, 0xee, 0x32, 0xd4, 0xd1, 0xe0, 0x13, 0x74, 0x23, 0x4a, 0x9a, 0xc4, 0x45, 0x9a,
+	0x67, 0x0d, 0xef, 0x35, 0xcd, 0x4b, 0xb6, 0xe5, 0x9d, 0xe9, 0x2a, 0xda, 0x33, 0x24, 0x66, 0x87,
+	0x9f, 0xa0, 0xdb, 0x8d, 0x39, 0x79, 0x99, 0x2d, 0xd2, 0x5c, 0x40, 0xa2, 0xb8, 0x38, 0x0f, 0x76,
+	0xf4, 0x3d, 0x6e, 0x59, 0x60, 0xe6, 0xe2, 0xf8, 0x05, 0xea, 0xba, 0x7e, 0x05, 0xbb, 0x5a, 0xfc,
+	0x9e, 0x13, 0x77, 0x0d, 0x23, 0x33, 0x9b, 0x40, 0x57, 0xa9, 0xf8, 0x00, 0xed, 0x25, 0x51, 0x99,
+	0x00, 0x63, 0x90, 0x06, 0xfe, 0xd0, 0x1b, 0x77, 0xe9, 0x3a, 0x30, 0x7a, 0x85, 0x7a, 0x14, 0x4a,
+	0x38, 0x73, 0xcd, 0xbb, 0xcc, 0xcc, 0x75, 0x43, 0x3b, 0xed, 0x86, 0x8e, 0x7e, 0x78, 0xe8, 0xe6,
+	0x07, 0x5e, 0x54, 0x0c, 0x14, 0x5c, 0xa1, 0x1e, 0xcf, 0x91, 0x2f, 0x40, 0xd6, 0xcc, 0x79, 0x79,
+	0xb8, 0xad, 0x97, 0xef, 0xb4, 0x87, 0x54, 0xd7, 0x52, 0xcb, 0x81, 0x1f, 0x23, 0xdf, 0x8c, 0xa5,
+	0x36, 0x70, 0x7f, 0x8a, 0x1d, 0x9b, 0xa8, 0x12, 0x72, 0xa2, 0x11, 0x6a, 0x33, 0xa6, 0xbf, 0x3c,
+	0xe4, 0xeb, 0xe1, 0x91, 0xf8, 0xa3, 0x1b, 0xa3, 0x87, 0xe4, 0xd2, 0xc7, 0x44, 0xda, 0xb3, 0x3d,
+	0x38, 0xf8, 0x57, 0x52, 0xc3, 0xa5, 0xcd, 0xdc, 0xc8, 0xd5, 0xb6, 0xfa, 0xbf, 0x5c, 0x5d, 0xe7,
+	0x2d, 0x7e, 0xb4, 0x21, 0xf3, 0x82, 0xf9, 0x83, 0xfe, 0x5f, 0xf3, 0x70, 0xd4, 0x3c, 0xe0, 0xf7,
+	0x6f, 0x3f, 0xbd, 0xc9, 0x72, 0xf5, 0xb9, 0x8e, 0x49, 0xc2, 0x8b, 0x50, 0x4c, 0xd3, 0xc3, 0x30,
+	0x8e, 0xbe, 0x03, 0x9b, 0x18, 0xda, 0xc9, 0xca, 0xe0, 0x49, 0xc6, 0xc3, 0xf6, 0xcf, 0xe6, 0xb5,
+	0x5e, 0x63, 0x5f, 0xf3, 0x3d, 0xff, 0x3d, 0x00, 0xd9, 0x6c, 0x12, 0xce, 0x89, 0x04, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// LeasesClient is the client API for Leases service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type LeasesClient interface {
+	// Waits for a queued action that the calling worker can run and leases
+	// it to the worker. A lease that is not renewed within its duration
+	// expires, and its action is queued again.
+	Lease(ctx context.Context, in *LeaseRequest, opts ...grpc.CallOption) (*Lease, error)
+	// Extends a lease by its duration.
+	Renew(ctx context.Context, in *RenewRequest, opts ...grpc.CallOption) (*Lease, error)
+	// Reports the outcome of a leased action and ends the lease.
+	Complete(ctx context.Context, in *CompleteRequest, opts ...grpc.CallOption) (*empty.Empty, error)
+}
+
+type leasesClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewLeasesClient(cc *grpc.ClientConn) LeasesClient {
+	return &leasesClient{cc}
+}
+
+func (c *leasesClient) Lease(ctx context.Context, in *LeaseRequest, opts ...grpc.CallOption) (*Lease, error) {
+	out := new(Lease)
+	err := c.cc.Invoke(ctx, "/remote_executor.lease.Leases/Lease", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *leasesClient) Renew(ctx context.Context, in *RenewRequest, opts ...grpc.CallOption) (*Lease, error) {
+	out := new(Lease)
+	err := c.cc.Invoke(ctx, "/remote_executor.lease.Leases/Renew", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *leasesClient) Complete(ctx context.Context, in *CompleteRequest, opts ...grpc.CallOption) (*empty.Empty, error) {
+	out := new(empty.Empty)
+	err := c.cc.Invoke(ctx, "/remote_executor.lease.Leases/Complete", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// LeasesServer is the server API for Leases service.
+type LeasesServer interface {
+	// Waits for a queued action that the calling worker can run and leases
+	// it to the worker. A lease that is not renewed within its duration
+	// expires, and its action is queued again.
+	Lease(context.Context, *LeaseRequest) (*Lease, error)
+	// Extends a lease by its duration.
+	Renew(context.Context, *RenewRequest) (*Lease, error)
+	// Reports the outcome of a leased action and ends the lease.
+	Complete(context.Context, *CompleteRequest) (*empty.Empty, error)
+}
+
+func RegisterLeasesServer(s *grpc.Server, srv LeasesServer) {
+	s.RegisterService(&_Leases_serviceDesc, srv)
+}
+
+func _Leases_Lease_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LeaseRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LeasesServer).Lease(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/remote_executor.lease.Leases/Lease",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LeasesServer).Lease(ctx, req.(*LeaseRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Leases_Renew_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RenewRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LeasesServer).Renew(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/remote_executor.lease.Leases/Renew",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LeasesServer).Renew(ctx, req.(*RenewRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Leases_Complete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CompleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LeasesServer).Complete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/remote_executor.lease.Leases/Complete",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LeasesServer).Complete(ctx, req.(*CompleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _Leases_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "remote_executor.lease.Leases",
+	HandlerType: (*LeasesServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Lease",
+			Handler:    _Leases_Lease_Handler,
+		},
+		{
+			MethodName: "Renew",
+			Handler:    _Leases_Renew_Handler,
+		},
+		{
+			MethodName: "Complete",
+			Handler:    _Leases_Complete_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "server/lease/lease.proto",
+}
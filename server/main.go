@@ -4,18 +4,32 @@ import (
 	"flag"
 	"log"
 	"net"
+	"net/http"
+	"runtime"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 
 	"github.com/r2d4/bazel-remote-execution-go/server/action_cache"
 	bs "github.com/r2d4/bazel-remote-execution-go/server/bytestream"
+	"github.com/r2d4/bazel-remote-execution-go/server/cache"
+	"github.com/r2d4/bazel-remote-execution-go/server/cache/disk_cache"
 	"github.com/r2d4/bazel-remote-execution-go/server/cache/gcs_cache"
+	"github.com/r2d4/bazel-remote-execution-go/server/cache/memory_cache"
+	"github.com/r2d4/bazel-remote-execution-go/server/cache/tiered_cache"
 	"github.com/r2d4/bazel-remote-execution-go/server/cas"
+	"github.com/r2d4/bazel-remote-execution-go/server/digest"
 	"github.com/r2d4/bazel-remote-execution-go/server/execution"
+	"github.com/r2d4/bazel-remote-execution-go/server/flags"
+	"github.com/r2d4/bazel-remote-execution-go/server/lease"
+	"github.com/r2d4/bazel-remote-execution-go/server/reapi_v2"
+	"github.com/r2d4/bazel-remote-execution-go/server/sandbox"
 	"github.com/r2d4/bazel-remote-execution-go/server/watch"
 
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"google.golang.org/genproto/googleapis/bytestream"
 	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/genproto/googleapis/longrunning"
 	watcher "google.golang.org/genproto/googleapis/watcher/v1"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
@@ -23,11 +37,38 @@ import (
 
 const (
 	port = ":50051"
+
+	maxMsgSize = 10 << 16
+	// Leave room for the rest of a batch message around the blobs.
+	maxBatchTotalSizeBytes = maxMsgSize / 2
 )
 
 var (
-	bucket    string
-	verbosity string
+	bucket          string
+	cacheDir        string
+	memBytes        int64
+	digestFunction  string
+	enableExecution bool
+	validateResults bool
+	execRootBase    string
+	keepExecRoots   bool
+	useSandbox      bool
+	envAllowlist    string
+	defaultTimeout  time.Duration
+	maxTimeout      time.Duration
+	opRetention     time.Duration
+	uploadTimeout   time.Duration
+	maxConcurrent   int
+	workersOnly     bool
+	leaseDuration   time.Duration
+	platform        string
+	platformRules   string
+	cgroupRoot      string
+	memoryLimit     string
+	cpuLimit        float64
+	pidsLimit       int64
+	debugAddr       string
+	verbosity       string
 )
 
 type srv struct {
@@ -38,8 +79,62 @@ type srv struct {
 	bs.ByteStreamSrv
 }
 
+// backend is a cache that can also serve bytestream reads and writes.
+type backend interface {
+	cache.Cache
+	bs.ReadHandler
+	bs.WriteHandler
+}
+
+// newBackend builds a cache from every backend selected by flags. When more
+// than one is selected they are layered fastest first: memory, disk, GCS.
+func newBackend() (backend, error) {
+	var tiers []backend
+	if memBytes > 0 {
+		tiers = append(tiers, memory_cache.NewMemoryCache(memBytes))
+	}
+	if cacheDir != "" {
+		c, err := disk_cache.NewDiskCache(cacheDir)
+		if err != nil {
+			return nil, err
+		}
+		tiers = append(tiers, c)
+	}
+	if bucket != "" {
+		c, err := gcs_cache.NewGCSCache(bucket)
+		if err != nil {
+			return nil, err
+		}
+		tiers = append(tiers, c)
+	}
+	if len(tiers) == 1 {
+		return tiers[0], nil
+	}
+	caches := make([]cache.Cache, len(tiers))
+	for i, t := range tiers {
+		caches[i] = t
+	}
+	return tiered_cache.NewTieredCache(caches...), nil
+}
+
 func NewServer() (*srv, error) {
-	cache, err := gcs_cache.NewGCSCache(bucket)
+	cache, err := newBackend()
+	if err != nil {
+		return nil, err
+	}
+	fn, err := digest.FromName(digestFunction)
+	if err != nil {
+		return nil, err
+	}
+	hostPlatform, err := execution.HostPlatform(platform)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := execution.ParseMatchRules(platformRules)
+	if err != nil {
+		return nil, err
+	}
+	limits, err := flags.ActionLimits(cgroupRoot, memoryLimit, cpuLimit, pidsLimit)
 	if err != nil {
 		return nil, err
 	}
@@ -47,36 +142,109 @@ func NewServer() (*srv, error) {
 	acChan := make(chan watcher.Change)
 	casChan := make(chan watcher.Change)
 
-	return &srv{
+	s := &srv{
 		ActionCacheSrv: action_cache.ActionCacheSrv{
-			Cache:      cache,
-			ActionChan: acChan,
+			Cache:           cache,
+			DigestFunction:  fn,
+			ActionChan:      acChan,
+			ValidateResults: validateResults,
 		},
 		CASSrv: cas.CASSrv{
-			Cache:   cache,
-			CASChan: casChan,
+			Cache:          cache,
+			DigestFunction: fn,
+			CASChan:        casChan,
 		},
 		ExecutionSrv: execution.ExecutionSrv{
-			Cache:      cache,
-			ActionChan: acChan,
-			CASChan:    casChan,
+			Cache:                cache,
+			DigestFunction:       fn,
+			ExecRootBase:         execRootBase,
+			KeepExecRoots:        keepExecRoots,
+			Sandbox:              useSandbox,
+			EnvAllowlist:         flags.SplitList(envAllowlist),
+			DefaultTimeout:       defaultTimeout,
+			MaxTimeout:           maxTimeout,
+			OperationRetention:   opRetention,
+			MaxConcurrentActions: maxConcurrent,
+			WorkersOnly:          workersOnly,
+			LeaseDuration:        leaseDuration,
+			Platform:             hostPlatform,
+			PlatformRules:        rules,
+			CgroupRoot:           cgroupRoot,
+			ActionLimits:         limits,
+			ActionChan:           acChan,
+			CASChan:              casChan,
 		},
 		WatchSrv: watch.WatchSrv{
 			ActionChan: acChan,
 			CASChan:    casChan,
 		},
-		ByteStreamSrv: *bs.NewByteStreamSrv(cache, cache),
-	}, nil
+		ByteStreamSrv: *bs.NewByteStreamSrv(cache, cache, fn),
+	}
+	s.ExecutionSrv.ActionCache = &s.ActionCacheSrv
+	s.ByteStreamSrv.UploadTimeout = uploadTimeout
+	return s, nil
+}
+
+// registerV2 registers the REAPI v2 services, backed by the same caches
+// and executor as the v1test ones so old and new clients share results.
+// The Capabilities service describes exactly the services registered here.
+func registerV2(s *grpc.Server, impl *srv) {
+	caps := &reapi_v2.CapabilitiesSrv{
+		DigestFunction: impl.CASSrv.DigestFunction,
+		CAS: &reapi_v2.CASSrv{
+			CAS:                    &impl.CASSrv,
+			MaxBatchTotalSizeBytes: maxBatchTotalSizeBytes,
+		},
+		ActionCache: &reapi_v2.ActionCacheSrv{
+			ActionCache: &impl.ActionCacheSrv,
+		},
+	}
+	if enableExecution {
+		caps.Execution = &reapi_v2.ExecutionSrv{
+			Execution: &impl.ExecutionSrv,
+		}
+		repb.RegisterExecutionServer(s, caps.Execution)
+	}
+	repb.RegisterActionCacheServer(s, caps.ActionCache)
+	repb.RegisterContentAddressableStorageServer(s, caps.CAS)
+	repb.RegisterCapabilitiesServer(s, caps)
 }
 
 func main() {
+	// Returns unless this process was started as a sandbox's init process.
+	sandbox.Main()
+
 	flag.StringVar(&verbosity, "verbosity", "warn", "Logging verbosity.")
 	flag.StringVar(&bucket, "bucket", "", "GCS bucket to use as a bazel cache.")
+	flag.StringVar(&cacheDir, "cache_dir", "", "Local directory to use as a bazel cache. Layered in front of --bucket if both are set.")
+	flag.StringVar(&digestFunction, "digest_function", "sha1", "Hash function clients use to compute digests: sha1, sha256 or blake3.")
+	flag.Int64Var(&memBytes, "memory_cache_bytes", 0, "Size in bytes of an in-memory bazel cache. Layered in front of --cache_dir and --bucket if they are set.")
+	flag.BoolVar(&enableExecution, "enable_execution", true, "Serve the Execution service and run actions. Without it the server is only a cache.")
+
+	flag.StringVar(&execRootBase, "exec_root_base", "", "Directory under which each action gets a fresh exec root. Defaults to the system temp directory.")
+	flag.BoolVar(&keepExecRoots, "keep_exec_roots", false, "Leave exec roots in place after actions finish, for debugging.")
+	flag.BoolVar(&useSandbox, "sandbox", false, "Run actions in Linux namespaces that only expose their exec root, read-only system directories and no network unless the action's platform sets network=on.")
+	flag.StringVar(&envAllowlist, "env_allowlist", "", "Comma separated names of server environment variables, e.g. PATH,TMPDIR, passed on to actions that do not set them. Actions otherwise get exactly the environment in their Command.")
+	flag.DurationVar(&defaultTimeout, "default_action_timeout", 15*time.Minute, "How long commands of actions that do not set a timeout may run. 0 means no limit.")
+	flag.DurationVar(&maxTimeout, "max_action_timeout", time.Hour, "Longest timeout an action may ask for. 0 means no limit.")
+	flag.IntVar(&maxConcurrent, "max_concurrent_actions", runtime.NumCPU(), "How many actions the server runs at once. Others wait in a queue.")
+	flag.BoolVar(&workersOnly, "workers_only", false, "Leave all actions to workers connected through the Leases service instead of also running them on the server.")
+	flag.DurationVar(&leaseDuration, "lease_duration", execution.DefaultLeaseDuration, "How long a worker may go without renewing the lease on an action before the action is queued again.")
+	flag.StringVar(&platform, "platform", "", "Comma separated platform properties of this machine, e.g. pool=large,gpu=nvidia-t4, in addition to OSFamily and Arch. The server only runs actions whose platform they satisfy.")
+	flag.StringVar(&platformRules, "platform_rules", "", "Comma separated rules for matching action platform properties against those of the server and workers, e.g. gpu=prefix,pool=ignore. Rules are exact, prefix, ignore or ignorecase. OSFamily and Arch default to ignorecase, container-image, network and the action limits to ignore, and other properties must match exactly.")
+	flag.StringVar(&cgroupRoot, "cgroup_root", "", "Writable cgroup v2 directory, not holding the server itself, under which each action runs in a cgroup of its own that enforces the action limits and measures its peak memory and CPU time. Needs Linux 5.7 or newer. Actions are not limited if empty.")
+	flag.StringVar(&memoryLimit, "action_memory_limit", "", "Memory each action may use, e.g. 4G. Platforms can lower it with memory-limit. Actions using more are killed. No limit if empty.")
+	flag.Float64Var(&cpuLimit, "action_cpu_limit", 0, "CPUs each action may use, e.g. 2 or 0.5. Platforms can lower it with cpu-limit. No limit if 0.")
+	flag.Int64Var(&pidsLimit, "action_pids_limit", 0, "Processes and threads each action may run at once. Platforms can lower it with pids-limit. No limit if 0.")
+	flag.DurationVar(&opRetention, "operation_retention", time.Hour, "How long finished operations can still be looked up with the Operations service. 0 means until they are deleted.")
+	flag.DurationVar(&uploadTimeout, "upload_timeout", bs.DefaultUploadTimeout, "How long an unfinished ByteStream upload may go without writes before it is discarded. 0 means it is kept until it is finished.")
+	flag.BoolVar(&validateResults, "validate_action_results", true, "Only serve cached action results whose outputs are all still in the CAS.")
+	flag.StringVar(&debugAddr, "debug_addr", "", "Address to serve metrics on at /debug/vars, e.g. localhost:8080. Disabled if empty.")
 
 	flag.Parse()
 
-	if bucket == "" {
-		log.Fatalln("Please provide a value for the --bucket flag.")
+	if bucket == "" && cacheDir == "" && memBytes <= 0 {
+		log.Fatalln("Please provide a value for the --bucket, --cache_dir or --memory_cache_bytes flag.")
 	}
 	lvl, err := logrus.ParseLevel(verbosity)
 	if err != nil {
@@ -84,20 +252,33 @@ func main() {
 	}
 	logrus.SetLevel(lvl)
 
+	if debugAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(debugAddr, nil); err != nil {
+				logrus.Errorf("serving metrics on %s: %s", debugAddr, err)
+			}
+		}()
+	}
+
 	lis, err := net.Listen("tcp", port)
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
-	s := grpc.NewServer(grpc.MaxMsgSize(10 << 16))
+	s := grpc.NewServer(grpc.MaxMsgSize(maxMsgSize))
 	impl, err := NewServer()
 	if err != nil {
 		log.Fatalf("error creating server: %s", err)
 	}
-	pb.RegisterExecutionServer(s, impl)
+	if enableExecution {
+		pb.RegisterExecutionServer(s, impl)
+		longrunning.RegisterOperationsServer(s, impl)
+		lease.RegisterLeasesServer(s, impl)
+	}
 	pb.RegisterActionCacheServer(s, impl)
 	pb.RegisterContentAddressableStorageServer(s, impl)
 	watcher.RegisterWatcherServer(s, impl)
 	bytestream.RegisterByteStreamServer(s, impl)
+	registerV2(s, impl)
 
 	// Register reflection service on gRPC server.
 	reflection.Register(s)
@@ -0,0 +1,48 @@
+package reapi_v2
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/r2d4/bazel-remote-execution-go/server/action_cache"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+)
+
+// ActionCacheSrv implements the v2 ActionCache service on top of the v1test
+// one, so both versions read and write the same entries.
+type ActionCacheSrv struct {
+	ActionCache *action_cache.ActionCacheSrv
+}
+
+// GetActionResult implements ActionCacheServer.GetActionResult
+func (s *ActionCacheSrv) GetActionResult(ctx context.Context, in *repb.GetActionResultRequest) (*repb.ActionResult, error) {
+	logrus.Infof("[v2] [GetActionResult] %+v", in)
+	res, err := s.ActionCache.GetActionResult(ctx, &pb.GetActionResultRequest{
+		InstanceName: in.InstanceName,
+		ActionDigest: toV1Digest(in.ActionDigest),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return toV2ActionResult(res), nil
+}
+
+// UpdateActionResult implements ActionCacheServer.UpdateActionResult
+func (s *ActionCacheSrv) UpdateActionResult(ctx context.Context, in *repb.UpdateActionResultRequest) (*repb.ActionResult, error) {
+	logrus.Infof("[v2] [UpdateActionResult] %+v", in)
+	ar, err := toV1ActionResult(in.ActionResult)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.ActionCache.UpdateActionResult(ctx, &pb.UpdateActionResultRequest{
+		InstanceName: in.InstanceName,
+		ActionDigest: toV1Digest(in.ActionDigest),
+		ActionResult: ar,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return toV2ActionResult(res), nil
+}
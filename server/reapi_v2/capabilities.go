@@ -0,0 +1,65 @@
+package reapi_v2
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/r2d4/bazel-remote-execution-go/server/digest"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/bazelbuild/remote-apis/build/bazel/semver"
+)
+
+// CapabilitiesSrv implements the v2 Capabilities service. It reports what
+// the servers it was built from support, so clients can negotiate instead
+// of guessing.
+type CapabilitiesSrv struct {
+	DigestFunction *digest.Function
+	// CAS and ActionCache are nil when the server does not serve them.
+	CAS         *CASSrv
+	ActionCache *ActionCacheSrv
+	// Execution is nil when remote execution is disabled.
+	Execution *ExecutionSrv
+}
+
+// GetCapabilities implements Capabilities.GetCapabilities
+func (s *CapabilitiesSrv) GetCapabilities(ctx context.Context, in *repb.GetCapabilitiesRequest) (*repb.ServerCapabilities, error) {
+	logrus.Infof("[v2] [GetCapabilities] %+v", in)
+	fn := digestFunctionValue(s.DigestFunction)
+	caps := &repb.ServerCapabilities{
+		ExecutionCapabilities: &repb.ExecutionCapabilities{
+			DigestFunction: fn,
+			ExecEnabled:    s.Execution != nil,
+		},
+		LowApiVersion:  &semver.SemVer{Major: 2},
+		HighApiVersion: &semver.SemVer{Major: 2},
+	}
+	if s.CAS != nil {
+		// No compressors are advertised; blobs are always sent uncompressed.
+		caps.CacheCapabilities = &repb.CacheCapabilities{
+			DigestFunction: []repb.DigestFunction_Value{fn},
+			ActionCacheUpdateCapabilities: &repb.ActionCacheUpdateCapabilities{
+				UpdateEnabled: s.ActionCache != nil,
+			},
+			MaxBatchTotalSizeBytes:      s.CAS.MaxBatchTotalSizeBytes,
+			SymlinkAbsolutePathStrategy: repb.SymlinkAbsolutePathStrategy_DISALLOWED,
+		}
+	}
+	return caps, nil
+}
+
+// digestFunctionBLAKE3 is the value of BLAKE3 in DigestFunction.Value,
+// which the vendored remote-apis protos predate.
+const digestFunctionBLAKE3 repb.DigestFunction_Value = 9
+
+func digestFunctionValue(fn *digest.Function) repb.DigestFunction_Value {
+	switch fn {
+	case digest.SHA1:
+		return repb.DigestFunction_SHA1
+	case digest.SHA256:
+		return repb.DigestFunction_SHA256
+	case digest.BLAKE3:
+		return digestFunctionBLAKE3
+	}
+	return repb.DigestFunction_UNKNOWN
+}
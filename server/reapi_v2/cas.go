@@ -0,0 +1,142 @@
+package reapi_v2
+
+import (
+	"bytes"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/r2d4/bazel-remote-execution-go/server/cache"
+	"github.com/r2d4/bazel-remote-execution-go/server/cas"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// CASSrv implements the v2 ContentAddressableStorage service on top of the
+// v1test one, sharing its cache.
+type CASSrv struct {
+	CAS *cas.CASSrv
+	// MaxBatchTotalSizeBytes limits the total size of blobs sent in a
+	// single BatchUpdateBlobs or BatchReadBlobs call.
+	MaxBatchTotalSizeBytes int64
+}
+
+// FindMissingBlobs implements ContentAddressableStorage.FindMissingBlobs
+func (s *CASSrv) FindMissingBlobs(ctx context.Context, in *repb.FindMissingBlobsRequest) (*repb.FindMissingBlobsResponse, error) {
+	var req pb.FindMissingBlobsRequest
+	if err := convert(in, &req); err != nil {
+		return nil, err
+	}
+	res, err := s.CAS.FindMissingBlobs(ctx, &req)
+	if err != nil {
+		return nil, err
+	}
+	var out repb.FindMissingBlobsResponse
+	if err := convert(res, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// BatchUpdateBlobs implements ContentAddressableStorage.BatchUpdateBlobs
+func (s *CASSrv) BatchUpdateBlobs(ctx context.Context, in *repb.BatchUpdateBlobsRequest) (*repb.BatchUpdateBlobsResponse, error) {
+	var total int64
+	for _, r := range in.Requests {
+		total += int64(len(r.Data))
+	}
+	if total > s.MaxBatchTotalSizeBytes {
+		return nil, grpc.Errorf(codes.InvalidArgument, "uploading %d bytes, more than the maximum batch size of %d bytes", total, s.MaxBatchTotalSizeBytes)
+	}
+	var req pb.BatchUpdateBlobsRequest
+	if err := convert(in, &req); err != nil {
+		return nil, err
+	}
+	res, err := s.CAS.BatchUpdateBlobs(ctx, &req)
+	if err != nil {
+		return nil, err
+	}
+	var out repb.BatchUpdateBlobsResponse
+	if err := convert(res, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// BatchReadBlobs implements ContentAddressableStorage.BatchReadBlobs
+func (s *CASSrv) BatchReadBlobs(ctx context.Context, in *repb.BatchReadBlobsRequest) (*repb.BatchReadBlobsResponse, error) {
+	logrus.Infof("[v2] [BatchReadBlobs] %+v", in)
+	var total int64
+	for _, d := range in.Digests {
+		if err := s.CAS.DigestFunction.Validate(toV1Digest(d)); err != nil {
+			return nil, grpc.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		total += d.SizeBytes
+	}
+	if total > s.MaxBatchTotalSizeBytes {
+		return nil, grpc.Errorf(codes.InvalidArgument, "requested %d bytes, more than the maximum batch size of %d bytes", total, s.MaxBatchTotalSizeBytes)
+	}
+
+	responses := make([]*repb.BatchReadBlobsResponse_Response, len(in.Digests))
+	var wg sync.WaitGroup
+	for i, d := range in.Digests {
+		wg.Add(1)
+		go func(i int, d *repb.Digest) {
+			defer wg.Done()
+			res := &repb.BatchReadBlobsResponse_Response{
+				Digest: d,
+				Status: &status.Status{Code: int32(codes.OK)},
+			}
+			var b bytes.Buffer
+			err := s.CAS.Cache.Get(toV1Digest(d), &b)
+			if err == cache.ErrNotFound {
+				res.Status = &status.Status{Code: int32(codes.NotFound), Message: err.Error()}
+			} else if err != nil {
+				res.Status = &status.Status{Code: int32(codes.Internal), Message: err.Error()}
+			} else {
+				res.Data = b.Bytes()
+			}
+			responses[i] = res
+		}(i, d)
+	}
+	wg.Wait()
+	return &repb.BatchReadBlobsResponse{
+		Responses: responses,
+	}, nil
+}
+
+// GetTree implements ContentAddressableStorage.GetTree by streaming every
+// directory under the root, breadth first. Each response carries the token
+// of the page after it, so an interrupted stream can be resumed.
+func (s *CASSrv) GetTree(in *repb.GetTreeRequest, stream repb.ContentAddressableStorage_GetTreeServer) error {
+	logrus.Infof("[v2] [GetTree] %+v", in)
+	if err := s.CAS.DigestFunction.Validate(toV1Digest(in.RootDigest)); err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	token := in.PageToken
+	for {
+		dirs, next, err := s.CAS.TreePage(toV1Digest(in.RootDigest), token, int(in.PageSize))
+		if err != nil {
+			return err
+		}
+		res := &repb.GetTreeResponse{NextPageToken: next}
+		for _, dir := range dirs {
+			var d repb.Directory
+			if err := convert(dir, &d); err != nil {
+				return err
+			}
+			res.Directories = append(res.Directories, &d)
+		}
+		if err := stream.Send(res); err != nil {
+			return err
+		}
+		if next == "" {
+			return nil
+		}
+		token = next
+	}
+}
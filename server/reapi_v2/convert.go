@@ -0,0 +1,123 @@
+package reapi_v2
+
+import (
+	"github.com/golang/protobuf/proto"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// The v1test and v2 messages converted with convert use the same field
+// numbers for the fields they have in common, so round tripping through the
+// wire format converts between them and keeps the fields only one version
+// knows about. Messages whose fields differ, like the inlined contents of
+// OutputFile, are converted field by field below.
+func convert(from, to proto.Message) error {
+	b, err := proto.Marshal(from)
+	if err != nil {
+		return grpc.Errorf(codes.Internal, "marshalling %T: %v", from, err)
+	}
+	if err := proto.Unmarshal(b, to); err != nil {
+		return grpc.Errorf(codes.Internal, "converting %T to %T: %v", from, to, err)
+	}
+	return nil
+}
+
+func toV1Digest(d *repb.Digest) *pb.Digest {
+	if d == nil {
+		return nil
+	}
+	return &pb.Digest{
+		Hash:      d.Hash,
+		SizeBytes: d.SizeBytes,
+	}
+}
+
+func toV2Digest(d *pb.Digest) *repb.Digest {
+	if d == nil {
+		return nil
+	}
+	return &repb.Digest{
+		Hash:      d.Hash,
+		SizeBytes: d.SizeBytes,
+	}
+}
+
+func toV2ActionResult(res *pb.ActionResult) *repb.ActionResult {
+	if res == nil {
+		return nil
+	}
+	out := &repb.ActionResult{
+		ExitCode:     res.ExitCode,
+		StdoutRaw:    res.StdoutRaw,
+		StdoutDigest: toV2Digest(res.StdoutDigest),
+		StderrRaw:    res.StderrRaw,
+		StderrDigest: toV2Digest(res.StderrDigest),
+	}
+	for _, f := range res.OutputFiles {
+		out.OutputFiles = append(out.OutputFiles, &repb.OutputFile{
+			Path:         f.Path,
+			Digest:       toV2Digest(f.Digest),
+			IsExecutable: f.IsExecutable,
+			Contents:     f.Content,
+		})
+	}
+	for _, d := range res.OutputDirectories {
+		out.OutputDirectories = append(out.OutputDirectories, &repb.OutputDirectory{
+			Path:       d.Path,
+			TreeDigest: toV2Digest(d.TreeDigest),
+		})
+	}
+	return out
+}
+
+// toV1ActionResult rejects results holding what v1test cannot express,
+// output symlinks and execution metadata, rather than storing them with
+// those fields silently dropped.
+func toV1ActionResult(res *repb.ActionResult) (*pb.ActionResult, error) {
+	if res == nil {
+		return nil, nil
+	}
+	switch {
+	case len(res.OutputFileSymlinks) > 0:
+		return nil, grpc.Errorf(codes.InvalidArgument, "output_file_symlinks are not supported")
+	case len(res.OutputDirectorySymlinks) > 0:
+		return nil, grpc.Errorf(codes.InvalidArgument, "output_directory_symlinks are not supported")
+	case res.ExecutionMetadata != nil:
+		return nil, grpc.Errorf(codes.InvalidArgument, "execution_metadata is not supported")
+	}
+	out := &pb.ActionResult{
+		ExitCode:     res.ExitCode,
+		StdoutRaw:    res.StdoutRaw,
+		StdoutDigest: toV1Digest(res.StdoutDigest),
+		StderrRaw:    res.StderrRaw,
+		StderrDigest: toV1Digest(res.StderrDigest),
+	}
+	for _, f := range res.OutputFiles {
+		out.OutputFiles = append(out.OutputFiles, &pb.OutputFile{
+			Path:         f.Path,
+			Digest:       toV1Digest(f.Digest),
+			IsExecutable: f.IsExecutable,
+			Content:      f.Contents,
+		})
+	}
+	for _, d := range res.OutputDirectories {
+		out.OutputDirectories = append(out.OutputDirectories, &pb.OutputDirectory{
+			Path:       d.Path,
+			TreeDigest: toV1Digest(d.TreeDigest),
+		})
+	}
+	return out, nil
+}
+
+// toV2ExecuteResponse converts everything but the server logs, which the
+// executor does not produce.
+func toV2ExecuteResponse(res *pb.ExecuteResponse) *repb.ExecuteResponse {
+	return &repb.ExecuteResponse{
+		Result:       toV2ActionResult(res.Result),
+		CachedResult: res.CachedResult,
+		Status:       res.Status,
+	}
+}
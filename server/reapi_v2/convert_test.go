@@ -0,0 +1,60 @@
+package reapi_v2
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestToV1ActionResult(t *testing.T) {
+	d := &repb.Digest{Hash: "aa", SizeBytes: 1}
+	for _, c := range []struct {
+		desc     string
+		res      *repb.ActionResult
+		wantCode codes.Code
+	}{
+		{desc: "nothing"},
+		{
+			desc: "outputs",
+			res: &repb.ActionResult{
+				ExitCode:          1,
+				StdoutRaw:         []byte("out"),
+				StderrDigest:      d,
+				OutputFiles:       []*repb.OutputFile{{Path: "a", Digest: d, IsExecutable: true, Contents: []byte("a")}},
+				OutputDirectories: []*repb.OutputDirectory{{Path: "b", TreeDigest: d}},
+			},
+		},
+		{
+			desc:     "output file symlinks",
+			res:      &repb.ActionResult{OutputFileSymlinks: []*repb.OutputSymlink{{Path: "a", Target: "b"}}},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			desc:     "output directory symlinks",
+			res:      &repb.ActionResult{OutputDirectorySymlinks: []*repb.OutputSymlink{{Path: "a", Target: "b"}}},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			desc:     "execution metadata",
+			res:      &repb.ActionResult{ExecutionMetadata: &repb.ExecutedActionMetadata{Worker: "w"}},
+			wantCode: codes.InvalidArgument,
+		},
+	} {
+		v1, err := toV1ActionResult(c.res)
+		if got := grpc.Code(err); got != c.wantCode {
+			t.Errorf("%s: toV1ActionResult() = %v, want code %s", c.desc, err, c.wantCode)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		// Whatever is accepted comes back unchanged.
+		if got := toV2ActionResult(v1); !proto.Equal(got, c.res) {
+			t.Errorf("%s: round trip gave %v, want %v", c.desc, got, c.res)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package reapi_v2
+
+import (
+	"bytes"
+
+	"golang.org/x/net/context"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/r2d4/bazel-remote-execution-go/server/cache"
+	"github.com/r2d4/bazel-remote-execution-go/server/execution"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	pb "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/genproto/googleapis/longrunning"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// ExecutionSrv implements the v2 Execution service using the v1test
+// executor to run actions.
+type ExecutionSrv struct {
+	Execution *execution.ExecutionSrv
+}
+
+// Execute implements Execution.Execute
+func (s *ExecutionSrv) Execute(in *repb.ExecuteRequest, stream repb.Execution_ExecuteServer) error {
+	logrus.Infof("[v2] [Execute] %+v", in)
+	if err := s.Execution.DigestFunction.Validate(toV1Digest(in.ActionDigest)); err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	action, opts, err := s.getAction(in.ActionDigest)
+	if err != nil {
+		return err
+	}
+
+	opts.ActionDigest = toV1Digest(in.ActionDigest)
+	op, err := s.Execution.Start(stream.Context(), &pb.ExecuteRequest{
+		InstanceName:    in.InstanceName,
+		Action:          action,
+		SkipCacheLookup: in.SkipCacheLookup,
+	}, opts)
+	if err != nil {
+		return err
+	}
+	return s.watch(op, in.ActionDigest, stream)
+}
+
+// WaitExecution implements Execution.WaitExecution
+func (s *ExecutionSrv) WaitExecution(in *repb.WaitExecutionRequest, stream repb.Execution_WaitExecutionServer) error {
+	logrus.Infof("[v2] [WaitExecution] %+v", in)
+	op, ok := s.Execution.Operation(in.Name)
+	if !ok {
+		return grpc.Errorf(codes.NotFound, "operation %s not found", in.Name)
+	}
+	var d repb.Digest
+	if err := convert(op.ActionDigest, &d); err != nil {
+		return err
+	}
+	return s.watch(op, &d, stream)
+}
+
+type operationStream interface {
+	Send(*longrunning.Operation) error
+	Context() context.Context
+}
+
+// watch streams every stage of op until it has finished.
+func (s *ExecutionSrv) watch(op *execution.Operation, d *repb.Digest, stream operationStream) error {
+	for stage := op.Stage(); stage != pb.ExecuteOperationMetadata_COMPLETED; stage = op.Stage() {
+		update, err := operationFor(op.Name, d, repb.ExecutionStage_Value(stage), nil)
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(update); err != nil {
+			return err
+		}
+		select {
+		case <-op.Changed(stage):
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+
+	res := op.Response()
+	if res.Status != nil {
+		logrus.Warnf("[v2] Action %s failed: %s", op.Name, res.Status.Message)
+	}
+	last, err := operationFor(op.Name, d, repb.ExecutionStage_COMPLETED, toV2ExecuteResponse(res))
+	if err != nil {
+		return err
+	}
+	return stream.Send(last)
+}
+
+// getAction reads the v2 Action and its Command from the CAS and converts
+// them into the v1test Action the executor understands, along with the
+// settings v1test has no room for.
+func (s *ExecutionSrv) getAction(d *repb.Digest) (*pb.Action, execution.ActionOptions, error) {
+	var opts execution.ActionOptions
+	var action repb.Action
+	if err := s.getProto(d, &action); err != nil {
+		return nil, opts, err
+	}
+	var cmd repb.Command
+	if err := s.getProto(action.CommandDigest, &cmd); err != nil {
+		return nil, opts, err
+	}
+	var platform *pb.Platform
+	if cmd.Platform != nil {
+		platform = &pb.Platform{}
+		if err := convert(cmd.Platform, platform); err != nil {
+			return nil, opts, err
+		}
+	}
+	opts.WorkingDirectory = cmd.WorkingDirectory
+	return &pb.Action{
+		CommandDigest:     toV1Digest(action.CommandDigest),
+		InputRootDigest:   toV1Digest(action.InputRootDigest),
+		OutputFiles:       cmd.OutputFiles,
+		OutputDirectories: cmd.OutputDirectories,
+		Platform:          platform,
+		Timeout:           action.Timeout,
+		DoNotCache:        action.DoNotCache,
+	}, opts, nil
+}
+
+func (s *ExecutionSrv) getProto(d *repb.Digest, m proto.Message) error {
+	if err := s.Execution.DigestFunction.Validate(toV1Digest(d)); err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	var b bytes.Buffer
+	err := s.Execution.Cache.Get(toV1Digest(d), &b)
+	if err == cache.ErrNotFound {
+		return grpc.Errorf(codes.FailedPrecondition, "%T %s/%d not found", m, d.Hash, d.SizeBytes)
+	}
+	if err != nil {
+		return grpc.Errorf(codes.Internal, "%v", err)
+	}
+	if err := proto.Unmarshal(b.Bytes(), m); err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "decoding %T: %v", m, err)
+	}
+	return nil
+}
+
+func operationFor(name string, d *repb.Digest, stage repb.ExecutionStage_Value, resp *repb.ExecuteResponse) (*longrunning.Operation, error) {
+	meta, err := ptypes.MarshalAny(&repb.ExecuteOperationMetadata{
+		Stage:        stage,
+		ActionDigest: d,
+	})
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal, "marshalling ExecuteOperationMetadata to protobuf.Any %s", err)
+	}
+	op := &longrunning.Operation{
+		Name:     name,
+		Metadata: meta,
+	}
+	if resp == nil {
+		return op, nil
+	}
+	respAny, err := ptypes.MarshalAny(resp)
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal, "marshalling ExecuteResponse to protobuf.Any %s", err)
+	}
+	op.Done = true
+	op.Result = &longrunning.Operation_Response{
+		Response: respAny,
+	}
+	return op, nil
+}
@@ -0,0 +1,17 @@
+package sandbox
+
+// initArg is the argv[0] the server is re-executed with to set up a sandbox
+// before running the sandboxed command.
+const initArg = "bazel-remote-execution-sandbox-init"
+
+// Options describes the sandbox of a single command.
+type Options struct {
+	// ExecRoot is the only writable directory the command can see, apart
+	// from a private /tmp. It must be an absolute path.
+	ExecRoot string
+	// Dir is the working directory of the command, inside ExecRoot.
+	Dir string
+	// AllowNetwork lets the command use the host network. Otherwise it only
+	// gets a loopback interface of its own.
+	AllowNetwork bool
+}
@@ -0,0 +1,235 @@
+//go:build linux
+// +build linux
+
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// systemDirs are mounted read-only into every sandbox.
+var systemDirs = []string{"/bin", "/sbin", "/lib", "/lib32", "/lib64", "/usr", "/etc"}
+
+// Command returns a command that runs args inside new user, mount, PID, IPC
+// and UTS namespaces, and a new network namespace unless opts.AllowNetwork
+// is set. The server binary is re-executed as the sandbox's init process,
+// so Main must be called at the start of the server's main function.
+func Command(opts Options, args []string) (*exec.Cmd, error) {
+	if len(args) == 0 {
+		return nil, errors.New("sandbox: no command")
+	}
+	if !filepath.IsAbs(opts.ExecRoot) {
+		return nil, fmt.Errorf("sandbox: exec root %q is not absolute", opts.ExecRoot)
+	}
+	dir := opts.Dir
+	if dir == "" {
+		dir = opts.ExecRoot
+	}
+	network := "0"
+	if opts.AllowNetwork {
+		network = "1"
+	}
+	cmd := exec.Command("/proc/self/exe")
+	cmd.Args = append([]string{initArg, opts.ExecRoot, dir, network}, args...)
+	cmd.Dir = dir
+
+	flags := syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+	if !opts.AllowNetwork {
+		flags |= syscall.CLONE_NEWNET
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: uintptr(flags),
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getuid(), Size: 1},
+		},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getgid(), Size: 1},
+		},
+		GidMappingsEnableSetgroups: false,
+		// Take the sandbox down with the server.
+		Pdeathsig: syscall.SIGKILL,
+	}
+	return cmd, nil
+}
+
+// Main runs the sandbox's init process if the binary was started as one by
+// Command, and returns immediately otherwise.
+//
+// The init process is PID 1 of the sandbox's PID namespace, so when it exits
+// after the command does, the kernel kills every process the command left
+// behind.
+func Main() {
+	if len(os.Args) < 5 || os.Args[0] != initArg {
+		return
+	}
+	execRoot, dir, allowNetwork, args := os.Args[1], os.Args[2], os.Args[3] == "1", os.Args[4:]
+	if err := setup(execRoot, allowNetwork); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		os.Exit(1)
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = dir
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err == nil {
+		os.Exit(0)
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			if ws.Signaled() {
+				os.Exit(128 + int(ws.Signal()))
+			}
+			os.Exit(ws.ExitStatus())
+		}
+	}
+	fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+	os.Exit(1)
+}
+
+// setup replaces the root filesystem with a tmpfs holding read-only system
+// directories, /dev, a fresh /proc and /tmp, and the exec root at its
+// original path.
+func setup(execRoot string, allowNetwork bool) error {
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %v", err)
+	}
+	// The new root is mounted over /tmp, which may hide the exec root, so
+	// keep a handle to it.
+	fd, err := syscall.Open(execRoot, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return fmt.Errorf("opening exec root: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	newRoot := "/tmp"
+	if err := syscall.Mount("tmpfs", newRoot, "tmpfs", 0, "mode=0755"); err != nil {
+		return fmt.Errorf("mounting root: %v", err)
+	}
+	for _, d := range systemDirs {
+		if err := bindReadOnly(d, filepath.Join(newRoot, d)); err != nil {
+			return err
+		}
+	}
+	if err := bind("/dev", filepath.Join(newRoot, "dev")); err != nil {
+		return err
+	}
+	if err := mkdirMount("proc", filepath.Join(newRoot, "proc"), "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return err
+	}
+	if err := mkdirMount("tmpfs", filepath.Join(newRoot, "tmp"), "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return err
+	}
+	if err := bind(fmt.Sprintf("/proc/self/fd/%d", fd), filepath.Join(newRoot, execRoot)); err != nil {
+		return err
+	}
+
+	if err := syscall.Chdir(newRoot); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivot_root: %v", err)
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmounting old root: %v", err)
+	}
+	if err := syscall.Chdir("/"); err != nil {
+		return err
+	}
+	if err := syscall.Mount("", "/", "", syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+		return fmt.Errorf("remounting root read-only: %v", err)
+	}
+	if !allowNetwork {
+		if err := loopbackUp(); err != nil {
+			return fmt.Errorf("bringing up loopback: %v", err)
+		}
+	}
+	return nil
+}
+
+func mkdirMount(source, target, fstype string, flags uintptr, data string) error {
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount(source, target, fstype, flags, data); err != nil {
+		return fmt.Errorf("mounting %s on %s: %v", source, target, err)
+	}
+	return nil
+}
+
+func bind(source, target string) error {
+	return mkdirMount(source, target, "", syscall.MS_BIND|syscall.MS_REC, "")
+}
+
+// bindReadOnly mounts source read-only at target. Missing sources are
+// skipped and symlinks, like /lib -> usr/lib, are recreated as symlinks.
+func bindReadOnly(source, target string) error {
+	fi, err := os.Lstat(source)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(source)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, target)
+	}
+	if err := bind(source, target); err != nil {
+		return err
+	}
+	// A remount inside a user namespace must keep the flags that are locked
+	// on the original mount.
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(source, &st); err != nil {
+		return err
+	}
+	flags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY)
+	for stFlag, msFlag := range map[int64]uintptr{
+		1 << 1:  syscall.MS_NOSUID,
+		1 << 2:  syscall.MS_NODEV,
+		1 << 3:  syscall.MS_NOEXEC,
+		1 << 10: syscall.MS_NOATIME,
+		1 << 11: syscall.MS_NODIRATIME,
+		1 << 12: syscall.MS_RELATIME,
+	} {
+		if int64(st.Flags)&stFlag != 0 {
+			flags |= msFlag
+		}
+	}
+	if err := syscall.Mount("", target, "", flags, ""); err != nil {
+		return fmt.Errorf("remounting %s read-only: %v", target, err)
+	}
+	return nil
+}
+
+// loopbackUp brings up the loopback interface of a new network namespace,
+// which starts out down.
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	var req struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(req.name[:], "lo")
+	req.flags = syscall.IFF_UP | syscall.IFF_RUNNING
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package sandbox
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// Command is not supported outside of Linux.
+func Command(opts Options, args []string) (*exec.Cmd, error) {
+	return nil, errors.New("sandbox: only supported on linux")
+}
+
+// Main does nothing outside of Linux.
+func Main() {}
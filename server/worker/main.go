@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+
+	"golang.org/x/net/context"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/r2d4/bazel-remote-execution-go/server/cache/remote_cache"
+	"github.com/r2d4/bazel-remote-execution-go/server/digest"
+	"github.com/r2d4/bazel-remote-execution-go/server/execution"
+	"github.com/r2d4/bazel-remote-execution-go/server/flags"
+	"github.com/r2d4/bazel-remote-execution-go/server/lease"
+	"github.com/r2d4/bazel-remote-execution-go/server/sandbox"
+
+	"google.golang.org/grpc"
+)
+
+var (
+	server         string
+	instanceName   string
+	name           string
+	concurrency    int
+	digestFunction string
+	execRootBase   string
+	keepExecRoots  bool
+	useSandbox     bool
+	envAllowlist   string
+	platform       string
+	cgroupRoot     string
+	memoryLimit    string
+	cpuLimit       float64
+	pidsLimit      int64
+	verbosity      string
+)
+
+func main() {
+	// Returns unless this process was started as a sandbox's init process.
+	sandbox.Main()
+
+	hostname, _ := os.Hostname()
+	flag.StringVar(&server, "server", "localhost:50051", "Address of the server to lease actions from. Its CAS holds the inputs and outputs of the actions.")
+	flag.StringVar(&instanceName, "instance_name", "", "Instance of the server's CAS to use.")
+	flag.StringVar(&name, "name", fmt.Sprintf("%s-%d", hostname, os.Getpid()), "Name identifying this worker to the server.")
+	flag.IntVar(&concurrency, "concurrency", runtime.NumCPU(), "How many actions to run at once.")
+	flag.StringVar(&digestFunction, "digest_function", "sha1", "Hash function of the server: sha1, sha256 or blake3.")
+	flag.StringVar(&execRootBase, "exec_root_base", "", "Directory under which each action gets a fresh exec root. Defaults to the system temp directory.")
+	flag.BoolVar(&keepExecRoots, "keep_exec_roots", false, "Leave exec roots in place after actions finish, for debugging.")
+	flag.BoolVar(&useSandbox, "sandbox", false, "Run actions in Linux namespaces that only expose their exec root, read-only system directories and no network unless the action's platform sets network=on.")
+	flag.StringVar(&envAllowlist, "env_allowlist", "", "Comma separated names of worker environment variables, e.g. PATH,TMPDIR, passed on to actions that do not set them.")
+	flag.StringVar(&platform, "platform", "", "Comma separated platform properties of this worker, e.g. pool=large,gpu=nvidia-t4, in addition to OSFamily and Arch. Only actions whose platform they satisfy are leased to the worker.")
+	flag.StringVar(&cgroupRoot, "cgroup_root", "", "Writable cgroup v2 directory, not holding the worker itself, under which each action runs in a cgroup of its own that enforces the action limits and measures its peak memory and CPU time. Needs Linux 5.7 or newer. Actions are not limited if empty.")
+	flag.StringVar(&memoryLimit, "action_memory_limit", "", "Memory each action may use, e.g. 4G. Platforms can lower it with memory-limit. Actions using more are killed. No limit if empty.")
+	flag.Float64Var(&cpuLimit, "action_cpu_limit", 0, "CPUs each action may use, e.g. 2 or 0.5. Platforms can lower it with cpu-limit. No limit if 0.")
+	flag.Int64Var(&pidsLimit, "action_pids_limit", 0, "Processes and threads each action may run at once. Platforms can lower it with pids-limit. No limit if 0.")
+	flag.StringVar(&verbosity, "verbosity", "warn", "Logging verbosity.")
+	flag.Parse()
+
+	lvl, err := logrus.ParseLevel(verbosity)
+	if err != nil {
+		log.Fatalln("Unable to parse verbosity flag.")
+	}
+	logrus.SetLevel(lvl)
+	fn, err := digest.FromName(digestFunction)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	hostPlatform, err := execution.HostPlatform(platform)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	limits, err := flags.ActionLimits(cgroupRoot, memoryLimit, cpuLimit, pidsLimit)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	conn, err := grpc.Dial(server, grpc.WithInsecure())
+	if err != nil {
+		log.Fatalf("connecting to %s: %v", server, err)
+	}
+	defer conn.Close()
+
+	w := &execution.Worker{
+		Execution: &execution.ExecutionSrv{
+			Cache:          remote_cache.NewRemoteCache(conn, instanceName),
+			DigestFunction: fn,
+			ExecRootBase:   execRootBase,
+			KeepExecRoots:  keepExecRoots,
+			Sandbox:        useSandbox,
+			EnvAllowlist:   flags.SplitList(envAllowlist),
+			Platform:       hostPlatform,
+			CgroupRoot:     cgroupRoot,
+			ActionLimits:   limits,
+		},
+		Leases:      lease.NewLeasesClient(conn),
+		Name:        name,
+		Concurrency: concurrency,
+	}
+	logrus.Infof("Leasing actions from %s as %s...", server, name)
+	w.Run(context.Background())
+}